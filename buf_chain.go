@@ -1,6 +1,7 @@
 package gonetz
 
 import (
+	"bytes"
 	"sync"
 )
 
@@ -52,10 +53,12 @@ func (bc *BufChain) growChain() {
 	chunkIf := bufPool4K.Get()
 	chunk := chunkIf.([]byte)[:0]
 
+	if len(bc.chain) == 0 {
+		bc.posInFirstChunk = 0
+	} // иначе первый чанк мог быть уже частично прочитан
+
 	bc.chain = append(bc.chain, chunk)
 	bc.chainIf = append(bc.chainIf, chunkIf)
-
-	bc.posInFirstChunk = 0
 }
 
 func (bc *BufChain) appendToLast(buf []byte) int {
@@ -81,32 +84,57 @@ func (bc *BufChain) appendToLast(buf []byte) int {
 // Read реализует io.Reader.
 // Никогда не возвращает error
 func (bc *BufChain) Read(buf []byte) (n int, _ error) {
+	n = bc.peek(buf)
+	bc.Discard(n)
+
+	return
+}
+
+// peek копирует в buf начало непрочитанных данных, не вычитывая их
+func (bc *BufChain) peek(buf []byte) (n int) {
+	pos := bc.posInFirstChunk
+
+	for _, chunk := range bc.chain {
+		n += copy(buf[n:], chunk[pos:])
+		if n == len(buf) {
+			break
+		}
+		pos = 0
+	}
+
+	return
+}
+
+// Discard пропускает n первых непрочитанных байт без копирования.
+// Возвращает количество реально пропущенных байт (не больше Len())
+func (bc *BufChain) Discard(n int) int {
+	if n > bc.totalLen {
+		n = bc.totalLen
+	}
+
 	var (
-		bufPos    int
-		bufLen    = len(buf)
+		left      = n
 		oldChunks = -1 // максимальный номер чанка, который уже не нужен
 	)
 
 	for chunkIdx, chunk := range bc.chain {
-		ch := chunk[bc.posInFirstChunk:]
-		rdd := copy(buf[bufPos:], ch)
-
-		if rdd > 0 {
-			n += rdd
-			bc.totalLen -= rdd
-
-			if bc.posInFirstChunk += rdd; bc.posInFirstChunk >= len(chunk) {
-				// текущий чанк закончился
-				bc.posInFirstChunk = 0
-				oldChunks = chunkIdx
-			}
+		if left == 0 {
+			break
+		}
 
-			if bufPos += rdd; bufPos == bufLen {
-				break
-			}
+		if avail := len(chunk) - bc.posInFirstChunk; left < avail {
+			bc.posInFirstChunk += left
+			left = 0
+		} else {
+			// текущий чанк закончился
+			left -= avail
+			bc.posInFirstChunk = 0
+			oldChunks = chunkIdx
 		}
 	}
 
+	bc.totalLen -= n
+
 	// Если последний чанк прочитал полностью, то не возвращаю его в пул, а оставляю на будущее,
 	//   чтобы уменьшить число взаимодействий с sync.Pool
 	if (oldChunks > -1) && (oldChunks == len(bc.chain)-1) {
@@ -130,7 +158,71 @@ func (bc *BufChain) Read(buf []byte) (n int, _ error) {
 		}
 	}
 
-	return
+	return n
+}
+
+// Index возвращает позицию первого вхождения sep в непрочитанных данных или -1, если его нет.
+// sep может оказаться на границе чанков
+func (bc *BufChain) Index(sep []byte) int {
+	if len(sep) == 0 {
+		return 0
+	}
+
+	pos := 0 // позиция начала текущего чанка в непрочитанных данных
+	for chunkIdx, chunk := range bc.chain {
+		if chunkIdx == 0 {
+			chunk = chunk[bc.posInFirstChunk:]
+		}
+
+		// вхождение целиком внутри чанка всегда раньше вхождений через его границу
+		if idx := bytes.Index(chunk, sep); idx != -1 {
+			return pos + idx
+		}
+
+		// вхождение через границу с последующими чанками
+		crossFrom := len(chunk) - len(sep) + 1
+		if crossFrom < 0 {
+			crossFrom = 0
+		}
+		for i := crossFrom; i < len(chunk); i++ {
+			if bc.hasPrefixAt(chunk[i:], chunkIdx+1, sep) {
+				return pos + i
+			}
+		}
+
+		pos += len(chunk)
+	}
+
+	return -1
+}
+
+// hasPrefixAt сообщает, начинаются ли данные с sep, если их читать с chunk и далее с чанка next цепочки
+func (bc *BufChain) hasPrefixAt(chunk []byte, next int, sep []byte) bool {
+	for {
+		n := len(chunk)
+		if n > len(sep) {
+			n = len(sep)
+		}
+
+		if !bytes.Equal(chunk[:n], sep[:n]) {
+			return false
+		} else if sep = sep[n:]; len(sep) == 0 {
+			return true
+		} else if next >= len(bc.chain) {
+			return false
+		}
+
+		chunk = bc.chain[next]
+		next++
+	}
+}
+
+// head возвращает непрочитанную часть первого чанка без копирования
+func (bc *BufChain) head() []byte {
+	if bc.totalLen == 0 {
+		return nil
+	}
+	return bc.chain[0][bc.posInFirstChunk:]
 }
 
 // Clean очищает внутренние буферы, чтобы перевести буфер в изначальное состояние.
@@ -366,3 +366,119 @@ func Test_BufChain_WriteRead_oneChunk(t *testing.T) {
 		}
 	}
 }
+
+func Test_BufChain_Discard(t *testing.T) {
+	var (
+		bc  BufChain
+		buf = bytes.Repeat([]byte(`1234567890`), 1000)
+	)
+
+	if got, exp := bc.Discard(10), 0; got != exp {
+		t.Fatalf(`Discard on empty chain expect %d got %d`, exp, got)
+	}
+
+	for _, step := range [...]int{1, 7, 42, 4096, 5000} {
+		bc.Clean()
+		bc.Write(buf)
+
+		var readed []byte
+		for bc.Len() > 0 {
+			head := bc.head()
+			if len(head) == 0 {
+				t.Fatalf(`empty head with Len() == %d (step %d)`, bc.Len(), step)
+			}
+			if len(head) > step {
+				head = head[:step]
+			}
+			readed = append(readed, head...)
+
+			if got, exp := bc.Discard(len(head)), len(head); got != exp {
+				t.Fatalf(`Discard (step %d) expect %d got %d`, step, exp, got)
+			}
+		}
+
+		if !bytes.Equal(readed, buf) {
+			t.Fatalf(`readed via head+Discard data differs (step %d)`, step)
+		}
+
+		if got, exp := len(bc.chain), 1; got != exp {
+			t.Fatalf(`chain len after full Discard (step %d) expect %d got %d`, step, exp, got)
+		}
+	}
+
+	bc.Clean()
+	bc.Write(buf)
+	if got, exp := bc.Discard(len(buf)*2), len(buf); got != exp {
+		t.Fatalf(`Discard more than Len() expect %d got %d`, exp, got)
+	}
+	if got, exp := bc.Len(), 0; got != exp {
+		t.Fatalf(`Len after Discard expect %d got %d`, exp, got)
+	}
+	if bc.head() != nil {
+		t.Fatalf(`head of empty chain is not nil`)
+	}
+}
+
+func Test_BufChain_WriteAfterPartialRead(t *testing.T) {
+	var (
+		bc   BufChain
+		head = bytes.Repeat([]byte(`a`), 4000)
+		tail = bytes.Repeat([]byte(`0123456789`), 100)
+	)
+
+	// первый чанк прочитан частично, а новые данные уже не влезают в последний чанк
+	bc.Write(head)
+	bc.Discard(len(head) - 10)
+	bc.Write(tail)
+
+	buf := make([]byte, bc.Len())
+	bc.Read(buf)
+	if exp := append(head[len(head)-10:], tail...); !bytes.Equal(buf, exp) {
+		t.Fatalf(`data after partial read differs`)
+	}
+}
+
+func Test_BufChain_Index(t *testing.T) {
+	var bc BufChain
+
+	if got := bc.Index([]byte("\n")); got != -1 {
+		t.Fatalf(`Index on empty chain expect -1 got %d`, got)
+	}
+
+	// разделитель в разных местах относительно границ чанков (4096 байт), в т.ч. посередине
+	for _, sepPos := range [...]int{0, 100, 4094, 4095, 4096, 8190, 9000} {
+		for _, sep := range [...]string{"\n", "\r\n", "--boundary--"} {
+			bc.Clean()
+			// начало чанка уже частично прочитано
+			bc.Write([]byte(`skip`))
+			bc.Discard(4)
+
+			data := bytes.Repeat([]byte(`x`), sepPos)
+			data = append(data, sep...)
+			data = append(data, bytes.Repeat([]byte(`y`), 5000)...)
+			data = append(data, sep...)
+			bc.Write(data)
+
+			if got := bc.Index([]byte(sep)); got != sepPos {
+				t.Fatalf(`Index of %q at %d: got %d`, sep, sepPos, got)
+			}
+
+			bc.Discard(sepPos + len(sep))
+			if got, exp := bc.Index([]byte(sep)), 5000; got != exp {
+				t.Fatalf(`second Index of %q: expect %d got %d`, sep, exp, got)
+			}
+		}
+	}
+
+	bc.Clean()
+	bc.Write(bytes.Repeat([]byte(`-`), 5000))
+	if got := bc.Index([]byte(`--boundary--`)); got != -1 {
+		t.Fatalf(`Index of missing separator expect -1 got %d`, got)
+	}
+	if got := bc.Index([]byte(`----`)); got != 0 {
+		t.Fatalf(`Index of repeated pattern expect 0 got %d`, got)
+	}
+	if got := bc.Index(nil); got != 0 {
+		t.Fatalf(`Index of empty separator expect 0 got %d`, got)
+	}
+}
@@ -0,0 +1,201 @@
+package gonetz
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+type (
+	// FramePrefix - формат префикса длины кадра FrameCodec
+	FramePrefix int
+
+	// FrameEvent - callback на получение полного кадра (без префикса длины).
+	// frame действителен только до возврата из callback: он может указывать прямо в RdBuf.
+	// Если callback вернет false, то соединение будет закрыто после отправки всех данных из WrBuf
+	FrameEvent func(conn *TCPConn, frame []byte) bool
+
+	// FrameCodec разбивает входящий поток на кадры с префиксом длины и кодирует исходящие кадры.
+	// Подключается как обработчик чтения: srv.OnClientRead(codec.OnClientRead).
+	// Соединения с некорректным префиксом или кадром больше MaxFrameSize закрываются с CloseReasonProtocol.
+	// Порог приостановки чтения (ServerOptions.ReadHighWater) должен быть больше MaxFrameSize с префиксом,
+	// иначе большой кадр никогда не будет дочитан
+	FrameCodec struct {
+		// Prefix - формат префикса длины. По умолчанию FrameUint32BE
+		Prefix FramePrefix
+		// MaxFrameSize - максимальный размер кадра без префикса. По умолчанию DefaultMaxFrameSize
+		MaxFrameSize int
+		// OnFrame вызывается для каждого полученного кадра
+		OnFrame FrameEvent
+	}
+)
+
+const (
+	// FrameUint32BE - 4 байта, big endian (по умолчанию)
+	FrameUint32BE FramePrefix = iota
+	// FrameUint32LE - 4 байта, little endian
+	FrameUint32LE
+	// FrameUint16BE - 2 байта, big endian
+	FrameUint16BE
+	// FrameUint16LE - 2 байта, little endian
+	FrameUint16LE
+	// FrameUint64BE - 8 байт, big endian
+	FrameUint64BE
+	// FrameUint64LE - 8 байт, little endian
+	FrameUint64LE
+	// FrameUvarint - unsigned varint (как в protobuf и encoding/binary.PutUvarint)
+	FrameUvarint
+)
+
+const (
+	// DefaultMaxFrameSize - ограничение размера кадра FrameCodec по умолчанию
+	DefaultMaxFrameSize = 1024 * 1024
+)
+
+var (
+	// ErrFrameTooLarge возвращается FrameCodec.WriteFrame для кадра больше MaxFrameSize
+	// (или больше, чем позволяет записать префикс)
+	ErrFrameTooLarge = fmt.Errorf(`frame is too large`)
+
+	errFramePrefix = fmt.Errorf(`malformed frame prefix`)
+)
+
+// OnClientRead - обработчик чтения (ConnEvent), вызывающий OnFrame для всех полностью полученных кадров из RdBuf.
+// Неполный кадр остается в RdBuf до следующего чтения
+func (codec *FrameCodec) OnClientRead(conn *TCPConn) bool {
+	var (
+		prefixBuf [binary.MaxVarintLen64]byte
+		maxSize   = uint64(codec.maxFrameSize())
+	)
+
+	for {
+		if mode, _ := conn.closeRequest(); mode != closeModeNone {
+			// кадры после CloseAfterFlush уже не нужны
+			return true
+		}
+
+		prefix := prefixBuf[:conn.RdBuf.peek(prefixBuf[:codec.Prefix.maxLen()])]
+		size, prefixLen, err := codec.Prefix.decode(prefix)
+		if (err != nil) || (size > maxSize) {
+			conn.requestClose(closeModeFlush, CloseReasonProtocol)
+			return true
+		} else if (prefixLen == 0) || (uint64(conn.RdBuf.Len()-prefixLen) < size) {
+			// кадр получен не полностью
+			return true
+		}
+
+		conn.RdBuf.Discard(prefixLen)
+
+		// кадр целиком в первом чанке отдается без копирования
+		frame := conn.RdBuf.head()
+		if uint64(len(frame)) >= size {
+			frame = frame[:size]
+		} else {
+			frame = make([]byte, size)
+			conn.RdBuf.peek(frame)
+		}
+
+		ok := codec.OnFrame(conn, frame)
+		conn.RdBuf.Discard(int(size))
+
+		if !ok {
+			return false
+		}
+	}
+}
+
+// WriteFrame записывает в соединение frame с префиксом длины (см. TCPConn.Write).
+// Префикс и кадр дописываются в WrBuf без промежуточной склейки (кроме TLS соединений)
+func (codec *FrameCodec) WriteFrame(conn *TCPConn, frame []byte) error {
+	if (len(frame) > codec.maxFrameSize()) || (uint64(len(frame)) > codec.Prefix.maxValue()) {
+		return ErrFrameTooLarge
+	}
+
+	var prefixBuf [binary.MaxVarintLen64]byte
+	prefix := prefixBuf[:codec.Prefix.encode(prefixBuf[:], uint64(len(frame)))]
+
+	return conn.writeParts(prefix, frame)
+}
+
+func (codec *FrameCodec) maxFrameSize() int {
+	if codec.MaxFrameSize <= 0 {
+		return DefaultMaxFrameSize
+	}
+	return codec.MaxFrameSize
+}
+
+// maxLen возвращает максимальную длину префикса
+func (p FramePrefix) maxLen() int {
+	switch p {
+	case FrameUint16BE, FrameUint16LE:
+		return 2
+	case FrameUint64BE, FrameUint64LE:
+		return 8
+	case FrameUvarint:
+		return binary.MaxVarintLen64
+	}
+	return 4
+}
+
+// maxValue возвращает максимальную длину кадра, которую можно записать в префикс
+func (p FramePrefix) maxValue() uint64 {
+	switch p {
+	case FrameUint16BE, FrameUint16LE:
+		return math.MaxUint16
+	case FrameUint64BE, FrameUint64LE, FrameUvarint:
+		return math.MaxUint64
+	}
+	return math.MaxUint32
+}
+
+// decode читает префикс из начала buf. n == 0 - префикс получен не полностью
+func (p FramePrefix) decode(buf []byte) (size uint64, n int, err error) {
+	if p == FrameUvarint {
+		if size, n = binary.Uvarint(buf); (n < 0) || ((n == 0) && (len(buf) >= binary.MaxVarintLen64)) {
+			// значение не влезает в 64 бита
+			return 0, 0, errFramePrefix
+		}
+		return size, n, nil
+	}
+
+	if n = p.maxLen(); len(buf) < n {
+		return 0, 0, nil
+	}
+
+	switch p {
+	case FrameUint16BE:
+		size = uint64(binary.BigEndian.Uint16(buf))
+	case FrameUint16LE:
+		size = uint64(binary.LittleEndian.Uint16(buf))
+	case FrameUint32LE:
+		size = uint64(binary.LittleEndian.Uint32(buf))
+	case FrameUint64BE:
+		size = binary.BigEndian.Uint64(buf)
+	case FrameUint64LE:
+		size = binary.LittleEndian.Uint64(buf)
+	default:
+		size = uint64(binary.BigEndian.Uint32(buf))
+	}
+	return size, n, nil
+}
+
+// encode записывает префикс для кадра размером size в buf (не меньше maxLen) и возвращает его длину
+func (p FramePrefix) encode(buf []byte, size uint64) int {
+	switch p {
+	case FrameUint16BE:
+		binary.BigEndian.PutUint16(buf, uint16(size))
+	case FrameUint16LE:
+		binary.LittleEndian.PutUint16(buf, uint16(size))
+	case FrameUint32LE:
+		binary.LittleEndian.PutUint32(buf, uint32(size))
+	case FrameUint64BE:
+		binary.BigEndian.PutUint64(buf, size)
+	case FrameUint64LE:
+		binary.LittleEndian.PutUint64(buf, size)
+	case FrameUvarint:
+		return binary.PutUvarint(buf, size)
+	default:
+		binary.BigEndian.PutUint32(buf, uint32(size))
+	}
+	return p.maxLen()
+}
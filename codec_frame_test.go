@@ -0,0 +1,150 @@
+package gonetz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_FramePrefix(t *testing.T) {
+	prefixes := []FramePrefix{
+		FrameUint32BE, FrameUint32LE, FrameUint16BE, FrameUint16LE, FrameUint64BE, FrameUint64LE, FrameUvarint,
+	}
+
+	for _, p := range prefixes {
+		for _, size := range []uint64{0, 1, 127, 128, 300, 65535} {
+			var buf [binary.MaxVarintLen64]byte
+			n := p.encode(buf[:], size)
+
+			if got, gotN, err := p.decode(buf[:n]); err != nil {
+				t.Fatalf(`prefix %d: decode of %d failed: %s`, p, size, err)
+			} else if (got != size) || (gotN != n) {
+				t.Fatalf(`prefix %d: expect %d (%d bytes) got %d (%d bytes)`, p, size, n, got, gotN)
+			}
+
+			if _, gotN, err := p.decode(buf[:n-1]); (err != nil) || (gotN != 0) {
+				t.Fatalf(`prefix %d: partial prefix of %d must wait for more data`, p, size)
+			}
+		}
+	}
+
+	if got := FrameUint16LE.encode(make([]byte, 2), 0x0102); got != 2 {
+		t.Fatalf(`wrong uint16 prefix length %d`, got)
+	}
+
+	buf := []byte{0x01, 0x02, 0x03, 0x04}
+	if size, _, _ := FrameUint32BE.decode(buf); size != 0x01020304 {
+		t.Fatalf(`wrong big endian decode %x`, size)
+	} else if size, _, _ := FrameUint32LE.decode(buf); size != 0x04030201 {
+		t.Fatalf(`wrong little endian decode %x`, size)
+	}
+
+	overflow := bytes.Repeat([]byte{0xFF}, binary.MaxVarintLen64)
+	if _, _, err := FrameUvarint.decode(overflow); err != errFramePrefix {
+		t.Fatalf(`varint overflow must fail, got %v`, err)
+	}
+}
+
+func Test_FrameCodec(t *testing.T) {
+	srv, addr := newTestServer(t, ServerOptions{})
+
+	codec := &FrameCodec{Prefix: FrameUvarint, MaxFrameSize: 64 * 1024}
+	codec.OnFrame = func(conn *TCPConn, frame []byte) bool {
+		if err := codec.WriteFrame(conn, frame); err != nil {
+			t.Errorf(`WriteFrame failed: %s`, err)
+		}
+		return true
+	}
+
+	reasons := make(chan CloseReason, 1)
+	srv.OnClientRead(codec.OnClientRead)
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		reasons <- reason
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.Dial(`tcp`, addr)
+	if err != nil {
+		t.Fatalf(`Dial failed: %s`, err)
+	}
+	defer client.Close()
+
+	frames := [][]byte{
+		[]byte(`hello`),
+		{},
+		bytes.Repeat([]byte(`x`), 300),
+		// больше чанка BufChain: кадр собирается копированием
+		bytes.Repeat([]byte(`0123456789`), 2000),
+	}
+
+	var stream []byte
+	for _, frame := range frames {
+		stream = binary.AppendUvarint(stream, uint64(len(frame)))
+		stream = append(stream, frame...)
+	}
+
+	// поток приходит частями, которые не совпадают с границами кадров
+	for _, part := range [][]byte{stream[:1], stream[1:7], stream[7:400], stream[400:]} {
+		if _, err := client.Write(part); err != nil {
+			t.Fatalf(`Write failed: %s`, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	echo := make([]byte, len(stream))
+	if _, err := io.ReadFull(client, echo); err != nil {
+		t.Fatalf(`Read echo failed: %s`, err)
+	} else if !bytes.Equal(echo, stream) {
+		t.Fatalf(`Echo mismatch`)
+	}
+
+	// кадр больше MaxFrameSize
+	if _, err := client.Write(binary.AppendUvarint(nil, 64*1024+1)); err != nil {
+		t.Fatalf(`Write failed: %s`, err)
+	}
+
+	select {
+	case reason := <-reasons:
+		if reason != CloseReasonProtocol {
+			t.Fatalf(`close reason mismatch: expect %s got %s`, CloseReasonProtocol, reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf(`Connection with too large frame was not closed`)
+	}
+}
+
+func Test_FrameCodec_WriteFrame(t *testing.T) {
+	conn := &TCPConn{}
+	codec := &FrameCodec{Prefix: FrameUint16LE}
+
+	if err := codec.WriteFrame(conn, []byte(`abc`)); err != nil {
+		t.Fatalf(`WriteFrame failed: %s`, err)
+	}
+
+	buf := make([]byte, conn.WrBuf.Len())
+	conn.WrBuf.Read(buf)
+	if exp := []byte("\x03\x00abc"); !bytes.Equal(buf, exp) {
+		t.Fatalf(`wrong encoded frame: expect %q got %q`, exp, buf)
+	}
+
+	if err := codec.WriteFrame(conn, make([]byte, 70000)); err != ErrFrameTooLarge {
+		t.Fatalf(`frame larger than uint16 prefix must fail, got %v`, err)
+	}
+
+	codec.MaxFrameSize = 2
+	if err := codec.WriteFrame(conn, []byte(`abc`)); err != ErrFrameTooLarge {
+		t.Fatalf(`frame larger than MaxFrameSize must fail, got %v`, err)
+	}
+
+	conn.SetWriteBufferLimit(10, 0)
+	codec.MaxFrameSize = 0
+	if err := codec.WriteFrame(conn, make([]byte, 9)); err != ErrBufferFull {
+		t.Fatalf(`frame over write buffer limit must fail, got %v`, err)
+	}
+}
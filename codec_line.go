@@ -0,0 +1,118 @@
+package gonetz
+
+import (
+	"fmt"
+)
+
+type (
+	// LineEvent - callback на получение строки (без разделителя).
+	// line действительна только до возврата из callback: она может указывать прямо в RdBuf.
+	// Если callback вернет false, то соединение будет закрыто после отправки всех данных из WrBuf
+	LineEvent func(conn *TCPConn, line []byte) bool
+
+	// LineCodec разбивает входящий поток на строки для текстовых протоколов.
+	// Подключается как обработчик чтения: srv.OnClientRead(codec.OnClientRead).
+	// Соединения со строкой длиннее MaxLineLength закрываются с CloseReasonProtocol.
+	// Порог приостановки чтения (ServerOptions.ReadHighWater) должен быть больше MaxLineLength с разделителем
+	LineCodec struct {
+		// Delimiter - разделитель строк. По умолчанию строки разделяются \n или \r\n
+		Delimiter []byte
+		// MaxLineLength - максимальная длина строки без разделителя. По умолчанию DefaultMaxLineLength
+		MaxLineLength int
+		// OnLine вызывается для каждой полученной строки
+		OnLine LineEvent
+	}
+)
+
+const (
+	// DefaultMaxLineLength - ограничение длины строки LineCodec по умолчанию
+	DefaultMaxLineLength = 64 * 1024
+)
+
+var (
+	// ErrLineTooLong возвращается LineCodec.WriteLine для строки длиннее MaxLineLength
+	ErrLineTooLong = fmt.Errorf(`line is too long`)
+
+	lineDelimiterLF   = []byte("\n")
+	lineDelimiterCRLF = []byte("\r\n")
+)
+
+// OnClientRead - обработчик чтения (ConnEvent), вызывающий OnLine для всех полностью полученных строк из RdBuf.
+// Неполная строка остается в RdBuf до следующего чтения
+func (codec *LineCodec) OnClientRead(conn *TCPConn) bool {
+	var (
+		delim   = codec.Delimiter
+		maxLen  = codec.maxLineLength()
+		trimCR  = len(delim) == 0
+		maxScan = maxLen + len(delim)
+	)
+
+	if trimCR {
+		delim = lineDelimiterLF
+		// \r перед \n тоже может быть частью строки максимальной длины
+		maxScan = maxLen + len(lineDelimiterCRLF)
+	}
+
+	for {
+		if mode, _ := conn.closeRequest(); mode != closeModeNone {
+			// строки после CloseAfterFlush уже не нужны
+			return true
+		}
+
+		idx := conn.RdBuf.Index(delim)
+		if idx == -1 {
+			if conn.RdBuf.Len() >= maxScan {
+				// разделителя нет даже на максимальной длине строки
+				conn.requestClose(closeModeFlush, CloseReasonProtocol)
+			}
+			return true
+		}
+
+		// строка целиком в первом чанке отдается без копирования
+		line := conn.RdBuf.head()
+		if len(line) >= idx {
+			line = line[:idx]
+		} else {
+			line = make([]byte, idx)
+			conn.RdBuf.peek(line)
+		}
+
+		if trimCR && (len(line) > 0) && (line[len(line)-1] == '\r') {
+			line = line[:len(line)-1]
+		}
+
+		if len(line) > maxLen {
+			conn.requestClose(closeModeFlush, CloseReasonProtocol)
+			return true
+		}
+
+		ok := codec.OnLine(conn, line)
+		conn.RdBuf.Discard(idx + len(delim))
+
+		if !ok {
+			return false
+		}
+	}
+}
+
+// WriteLine записывает в соединение line с разделителем (\r\n, если Delimiter не задан).
+// Строка и разделитель дописываются в WrBuf без промежуточной склейки (кроме TLS соединений)
+func (codec *LineCodec) WriteLine(conn *TCPConn, line []byte) error {
+	if len(line) > codec.maxLineLength() {
+		return ErrLineTooLong
+	}
+
+	delim := codec.Delimiter
+	if len(delim) == 0 {
+		delim = lineDelimiterCRLF
+	}
+
+	return conn.writeParts(line, delim)
+}
+
+func (codec *LineCodec) maxLineLength() int {
+	if codec.MaxLineLength <= 0 {
+		return DefaultMaxLineLength
+	}
+	return codec.MaxLineLength
+}
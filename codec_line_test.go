@@ -0,0 +1,148 @@
+package gonetz
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func startLineServer(t *testing.T, codec *LineCodec) (addr string, reasons chan CloseReason, stop func()) {
+	srv, addr := newTestServer(t, ServerOptions{})
+
+	reasons = make(chan CloseReason, 1)
+	srv.OnClientRead(codec.OnClientRead)
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		reasons <- reason
+	})
+
+	return addr, reasons, startTestServer(t, srv)
+}
+
+func Test_LineCodec(t *testing.T) {
+	codec := &LineCodec{MaxLineLength: 8192}
+	codec.OnLine = func(conn *TCPConn, line []byte) bool {
+		if string(line) == `QUIT` {
+			codec.WriteLine(conn, []byte(`BYE`))
+			return false
+		}
+		if err := codec.WriteLine(conn, append([]byte(`> `), line...)); err != nil {
+			t.Errorf(`WriteLine failed: %s`, err)
+		}
+		return true
+	}
+
+	addr, reasons, stop := startLineServer(t, codec)
+	defer stop()
+
+	client, err := net.Dial(`tcp`, addr)
+	if err != nil {
+		t.Fatalf(`Dial failed: %s`, err)
+	}
+	defer client.Close()
+
+	long := string(bytes.Repeat([]byte(`z`), 6000))
+	lines := []string{`HELO example.org`, ``, `unix line`, long, `QUIT`}
+
+	// строки с разными окончаниями, поток приходит частями не по границам строк
+	stream := []byte("HELO example.org\r\n\r\nunix line\n" + long + "\r\nQUIT\r\nignored\r\n")
+	for _, part := range [][]byte{stream[:5], stream[5:18], stream[18:19], stream[19:3000], stream[3000:]} {
+		if _, err := client.Write(part); err != nil {
+			t.Fatalf(`Write failed: %s`, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	reader := bufio.NewReader(client)
+	for _, line := range lines {
+		exp := `> ` + line + "\r\n"
+		if line == `QUIT` {
+			exp = "BYE\r\n"
+		}
+
+		if got, err := reader.ReadString('\n'); err != nil {
+			t.Fatalf(`Read failed: %s`, err)
+		} else if got != exp {
+			t.Fatalf(`expect %q got %q`, exp, got)
+		}
+	}
+
+	select {
+	case reason := <-reasons:
+		if reason != CloseReasonHandler {
+			t.Fatalf(`close reason mismatch: expect %s got %s`, CloseReasonHandler, reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf(`Connection was not closed after QUIT`)
+	}
+}
+
+func Test_LineCodec_Delimiter(t *testing.T) {
+	var got []string
+	codec := &LineCodec{Delimiter: []byte(`||`), MaxLineLength: 10}
+	codec.OnLine = func(conn *TCPConn, line []byte) bool {
+		got = append(got, string(line))
+		return true
+	}
+
+	addr, reasons, stop := startLineServer(t, codec)
+	defer stop()
+
+	client, err := net.Dial(`tcp`, addr)
+	if err != nil {
+		t.Fatalf(`Dial failed: %s`, err)
+	}
+	defer client.Close()
+
+	// разделитель приходит разорванным между чтениями, \n - обычный символ
+	for _, part := range []string{"a\nb|", "|0123456789||c", "d||0123456789XY"} {
+		if _, err := client.Write([]byte(part)); err != nil {
+			t.Fatalf(`Write failed: %s`, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case reason := <-reasons:
+		if reason != CloseReasonProtocol {
+			t.Fatalf(`close reason mismatch: expect %s got %s`, CloseReasonProtocol, reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf(`Connection with too long line was not closed`)
+	}
+
+	// после закрытия обработчики уже не вызываются, так что got можно читать
+	if exp := []string{"a\nb", `0123456789`, `cd`}; len(got) != len(exp) {
+		t.Fatalf(`expect lines %q got %q`, exp, got)
+	} else {
+		for i := range exp {
+			if got[i] != exp[i] {
+				t.Fatalf(`expect lines %q got %q`, exp, got)
+			}
+		}
+	}
+}
+
+func Test_LineCodec_WriteLine(t *testing.T) {
+	conn := &TCPConn{}
+	codec := &LineCodec{MaxLineLength: 4}
+
+	if err := codec.WriteLine(conn, []byte(`PING`)); err != nil {
+		t.Fatalf(`WriteLine failed: %s`, err)
+	} else if err := codec.WriteLine(conn, []byte(`TOOLONG`)); err != ErrLineTooLong {
+		t.Fatalf(`too long line must fail, got %v`, err)
+	}
+
+	codec.Delimiter = []byte{0}
+	if err := codec.WriteLine(conn, []byte(`PONG`)); err != nil {
+		t.Fatalf(`WriteLine failed: %s`, err)
+	}
+
+	buf := make([]byte, conn.WrBuf.Len())
+	conn.WrBuf.Read(buf)
+	if exp := []byte("PING\r\nPONG\x00"); !bytes.Equal(buf, exp) {
+		t.Fatalf(`wrong written lines: expect %q got %q`, exp, buf)
+	}
+}
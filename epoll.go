@@ -1,6 +1,7 @@
 package gonetz
 
 import (
+	"sync"
 	"syscall"
 	"unsafe"
 )
@@ -10,6 +11,10 @@ const (
 
 	// EPOLLET в syscall имеет неудобный тип, так что завожу свою константу
 	EPOLLET = 1 << 31
+
+	// флаги eventfd2 совпадают с O_NONBLOCK и O_CLOEXEC, но в syscall их нет
+	efdNonblock = syscall.O_NONBLOCK
+	efdCloexec  = syscall.O_CLOEXEC
 )
 
 type (
@@ -25,26 +30,46 @@ type (
 		events         []syscall.EpollEvent
 		eventsFirstPtr uintptr
 
+		// eventfd для пробуждения Wait из других горутин (см. Wakeup). Под wakeMu, т.к. закрывается в Close
+		wakeMu sync.Mutex
+		wakeFd int
+
 		WaitTimeout Millisecond
 	}
 )
 
 var (
-	// DefaultEPollWaitTimeout можно менять для изменения максимальной паузы при вызовах EPoll.Wait
-	DefaultEPollWaitTimeout = Millisecond(10)
+	// DefaultEPollWaitTimeout можно менять для изменения максимальной паузы при вызовах EPoll.Wait.
+	// По умолчанию Wait ждет бесконечно, а о закрытии и прочих командах из других горутин узнает через Wakeup
+	DefaultEPollWaitTimeout = Millisecond(-1)
 )
 
 // InitClientEpoll настраивает новый клиентский epoll
 func InitClientEpoll(epoll *EPoll) (err error) {
+	return initEpoll(epoll, maxEpollEvents)
+}
+
+// initEpoll настраивает новый epoll, получающий не более eventsCap событий за один Wait
+func initEpoll(epoll *EPoll, eventsCap int) (err error) {
+	if eventsCap < 1 {
+		eventsCap = maxEpollEvents
+	}
+
 	epoll.fd, err = syscallWrappers.EpollCreate1(0)
 	if err != nil {
 		return err
 	}
 
+	if err = epoll.initWakeup(); err != nil {
+		_ = syscall.Close(epoll.fd)
+		epoll.fd = 0
+		return err
+	}
+
 	epoll.WaitTimeout = DefaultEPollWaitTimeout
 
-	epoll.eventsCap = maxEpollEvents
-	epoll.events = make([]syscall.EpollEvent, maxEpollEvents)
+	epoll.eventsCap = eventsCap
+	epoll.events = make([]syscall.EpollEvent, eventsCap)
 	epoll.eventsFirstPtr = uintptr(unsafe.Pointer(&epoll.events[0]))
 
 	return nil
@@ -60,7 +85,7 @@ func InitServerEpoll(serverFd int, epoll *EPoll) (err error) {
 	epoll.event.Fd = int32(serverFd)
 
 	if err = syscall.EpollCtl(epoll.fd, syscall.EPOLL_CTL_ADD, serverFd, &epoll.event); err != nil {
-		_ = syscall.Close(epoll.fd)
+		_ = epoll.Close()
 		epoll.fd = 0
 		return err
 	}
@@ -68,6 +93,62 @@ func InitServerEpoll(serverFd int, epoll *EPoll) (err error) {
 	return nil
 }
 
+// initWakeup создает eventfd для Wakeup и добавляет его в epoll
+func (epoll *EPoll) initWakeup() (err error) {
+	r1, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, 0, efdNonblock|efdCloexec, 0)
+	if errno != 0 {
+		return errno
+	}
+	wakeFd := int(r1)
+
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(wakeFd)}
+	if err = syscall.EpollCtl(epoll.fd, syscall.EPOLL_CTL_ADD, wakeFd, &event); err != nil {
+		_ = syscall.Close(wakeFd)
+		return err
+	}
+
+	epoll.wakeFd = wakeFd
+	return nil
+}
+
+// Wakeup прерывает текущий (или ближайший) Wait. Может вызываться из любой горутины, в том числе после Close
+func (epoll *EPoll) Wakeup() error {
+	epoll.wakeMu.Lock()
+	defer epoll.wakeMu.Unlock()
+
+	if epoll.wakeFd == 0 {
+		return nil
+	}
+
+	one := uint64(1)
+	_, _, errno := syscall.Syscall(syscall.SYS_WRITE, uintptr(epoll.wakeFd), uintptr(unsafe.Pointer(&one)), 8)
+	if (errno != 0) && (errno != syscall.EAGAIN) { // EAGAIN - счетчик переполнен, т.е. пробуждение и так ожидается
+		return errno
+	}
+
+	return nil
+}
+
+// resetWakeup сбрасывает счетчик eventfd после пробуждения
+func (epoll *EPoll) resetWakeup() {
+	var cnt uint64
+	_, _, _ = syscall.Syscall(syscall.SYS_READ, uintptr(epoll.wakeFd), uintptr(unsafe.Pointer(&cnt)), 8)
+}
+
+// Close закрывает epoll и его eventfd. Дескрипторы, добавленные в epoll, не закрываются
+func (epoll *EPoll) Close() (err error) {
+	epoll.wakeMu.Lock()
+	wakeFd := epoll.wakeFd
+	epoll.wakeFd = 0
+	epoll.wakeMu.Unlock()
+
+	if wakeFd != 0 {
+		_ = syscall.Close(wakeFd)
+	}
+
+	return syscall.Close(epoll.fd)
+}
+
 // DeleteFd удаляет дескриптор fd из пула
 func (epoll *EPoll) DeleteFd(fd int) (err error) {
 	return syscall.EpollCtl(epoll.fd, syscall.EPOLL_CTL_DEL, fd, nil)
@@ -75,11 +156,18 @@ func (epoll *EPoll) DeleteFd(fd int) (err error) {
 
 // AddClient добавляет нового клиента в серверный пул
 func (epoll *EPoll) AddClient(clientFd int) (err error) {
-	epoll.event.Events = syscall.EPOLLIN | EPOLLET // | syscall.EPOLLOUT
-	epoll.event.Fd = int32(clientFd)
+	return epoll.addClient(clientFd, syscall.EPOLLIN|EPOLLET, true)
+}
+
+// addClient добавляет клиента с указанной маской событий. TCP опции выставляются только при tcp == true
+func (epoll *EPoll) addClient(clientFd int, events uint32, tcp bool) (err error) {
+	// epoll.event не использую, т.к. клиенты могут добавляться из разных горутин
+	event := syscall.EpollEvent{Events: events, Fd: int32(clientFd)}
 
 	if err = syscallWrappers.SetNonblock(clientFd, true); err != nil {
-	} else if err = syscall.EpollCtl(epoll.fd, syscall.EPOLL_CTL_ADD, clientFd, &epoll.event); err != nil {
+	} else if err = syscall.EpollCtl(epoll.fd, syscall.EPOLL_CTL_ADD, clientFd, &event); err != nil {
+	} else if !tcp {
+		return nil
 	} else if err = syscallWrappers.SetsockoptInt(clientFd, syscall.SOL_TCP, syscall.TCP_NODELAY, 1); err != nil {
 	} else if err = syscallWrappers.SetsockoptInt(clientFd, syscall.SOL_TCP, syscall.TCP_QUICKACK, 1); err != nil {
 	} else {
@@ -89,16 +177,43 @@ func (epoll *EPoll) AddClient(clientFd int) (err error) {
 	return err
 }
 
-// Wait блокируется до наступления события на любом из сокетов в пузе, либо на время epoll.WaitTimeout
+// ModifyClient меняет маску отслеживаемых событий для уже добавленного клиента
+func (epoll *EPoll) ModifyClient(clientFd int, events uint32) (err error) {
+	event := syscall.EpollEvent{Events: events, Fd: int32(clientFd)}
+	return syscall.EpollCtl(epoll.fd, syscall.EPOLL_CTL_MOD, clientFd, &event)
+}
+
+// Wait блокируется до наступления события на любом из сокетов в пуле, вызова Wakeup,
+// либо на время epoll.WaitTimeout (отрицательное значение - без ограничения)
 func (epoll *EPoll) Wait() (nEvents int, errno syscall.Errno) {
+	return epoll.WaitFor(epoll.WaitTimeout)
+}
+
+// WaitFor аналогичен Wait, но с явно указанным временем ожидания (0 - не блокироваться).
+// Событие от Wakeup в epoll.events не попадает, так что после пробуждения nEvents может быть 0
+func (epoll *EPoll) WaitFor(timeout Millisecond) (nEvents int, errno syscall.Errno) {
 	r1, _, errno := syscallWrappers.Syscall6(
 		syscall.SYS_EPOLL_WAIT,
 		uintptr(epoll.fd),
 		epoll.eventsFirstPtr,
 		uintptr(epoll.eventsCap),
-		uintptr(epoll.WaitTimeout),
+		uintptr(timeout),
 		0,
 		0,
 	)
-	return int(r1), errno
+	if errno != 0 {
+		return 0, errno
+	}
+
+	nEvents = int(r1)
+	for ev := 0; ev < nEvents; ev++ {
+		if (epoll.wakeFd != 0) && (int(epoll.events[ev].Fd) == epoll.wakeFd) {
+			epoll.resetWakeup()
+			nEvents--
+			epoll.events[ev] = epoll.events[nEvents]
+			break
+		}
+	}
+
+	return nEvents, 0
 }
@@ -3,6 +3,7 @@ package gonetz
 import (
 	"syscall"
 	"testing"
+	"time"
 )
 
 func Test_EPoll_InitClientEpoll(t *testing.T) {
@@ -232,3 +233,54 @@ func Test_EPoll_Wait(t *testing.T) {
 		t.Fatalf(`events mask (%d) != syscall.EPOLLHUP (%d)`, ev.Events, syscall.EPOLLHUP)
 	}
 }
+
+func Test_EPoll_Wakeup(t *testing.T) {
+	var epoll EPoll
+
+	if err := InitClientEpoll(&epoll); err != nil {
+		t.Fatalf(`InitClientEpoll failed: %s`, err)
+	}
+
+	if epoll.wakeFd == 0 {
+		t.Fatalf(`epoll.wakeFd == 0`)
+	}
+
+	if got, exp := epoll.WaitTimeout, Millisecond(-1); got != exp {
+		t.Fatalf(`default WaitTimeout expect %d got %d`, exp, got)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		if err := epoll.Wakeup(); err != nil {
+			t.Errorf(`Wakeup failed: %s`, err)
+		}
+	}()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		// событие от eventfd наружу не попадает
+		if n, errno := epoll.Wait(); (n != 0) || (errno != 0) {
+			t.Errorf(`Wait after Wakeup failed: nEvents=%d errno=%d`, n, errno)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`Wait was not interrupted by Wakeup`)
+	}
+
+	// счетчик eventfd сброшен, так что повторный Wait уже ничего не получит
+	if n, errno := epoll.WaitFor(0); (n != 0) || (errno != 0) {
+		t.Fatalf(`WaitFor after reset failed: nEvents=%d errno=%d`, n, errno)
+	}
+
+	if err := epoll.Close(); err != nil {
+		t.Fatalf(`Close failed: %s`, err)
+	}
+
+	if err := epoll.Wakeup(); err != nil {
+		t.Fatalf(`Wakeup after Close failed: %s`, err)
+	}
+}
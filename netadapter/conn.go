@@ -0,0 +1,418 @@
+package netadapter
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/atercattus/gonetz"
+)
+
+const (
+	// readHighWater - сколько прочитанных, но не забранных Read данных копится до приостановки чтения из сокета
+	readHighWater = 256 * 1024
+	// readLowWater - до какого объема Read должен разобрать данные, чтобы чтение из сокета возобновилось
+	readLowWater = 64 * 1024
+)
+
+var (
+	// ErrClosed возвращается при работе с уже закрытым Conn или Listener (как net.ErrClosed в Go 1.16+)
+	ErrClosed = fmt.Errorf(`use of closed network connection`)
+	// ErrDeadlineExceeded возвращается Read и Write по истечении дедлайна (как os.ErrDeadlineExceeded в Go 1.16+).
+	// Реализует net.Error с Timeout() == true
+	ErrDeadlineExceeded net.Error = deadlineExceededError{}
+)
+
+type (
+	// deadlineExceededError - тип ErrDeadlineExceeded
+	deadlineExceededError struct{}
+
+	// Conn реализует net.Conn поверх TCPConn.
+	// Данные из сокета копирует обработчик чтения воркера, а Write передает данные воркеру и ждет,
+	// пока они не уйдут в сокет
+	Conn struct {
+		tc     *gonetz.TCPConn
+		local  net.Addr
+		remote net.Addr
+
+		wrMu sync.Mutex // Write выполняются по одному
+
+		mu         sync.Mutex
+		changed    chan struct{} // закрывается при любом изменении полей ниже (см. notify)
+		rdBuf      []byte
+		rdOff      int // rdBuf[rdOff:] - еще не прочитанные данные
+		rdPaused   bool
+		err        error // ошибка после закрытия соединения (отдается Read после вычитывания rdBuf)
+		rdEOF      bool  // другая сторона закрыла свою сторону соединения, Read после rdBuf отдает io.EOF
+		closed     bool  // вызван Close
+		rdDeadline time.Time
+		wrDeadline time.Time
+
+		// поля ниже меняются только в горутине воркера
+		wrDone       chan error // ждущий отправки WrBuf Write
+		workerClosed bool       // OnClientClose уже вызван
+	}
+
+	// deadlineTimer - таймер дедлайна одного вызова Read или Write
+	deadlineTimer struct {
+		timer    *time.Timer
+		deadline time.Time // дедлайн, на который заведен timer
+	}
+)
+
+func (deadlineExceededError) Error() string   { return `i/o timeout` }
+func (deadlineExceededError) Timeout() bool   { return true }
+func (deadlineExceededError) Temporary() bool { return true }
+
+func newConn(tc *gonetz.TCPConn) *Conn {
+	c := &Conn{
+		tc:      tc,
+		local:   tc.LocalAddr(),
+		remote:  tc.RemoteAddr(),
+		changed: make(chan struct{}),
+	}
+	tc.Context = c
+	return c
+}
+
+// Read реализует net.Conn
+func (c *Conn) Read(b []byte) (n int, err error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	var timer deadlineTimer
+	defer timer.stop()
+
+	c.mu.Lock()
+	for {
+		if c.closed {
+			c.mu.Unlock()
+			return 0, ErrClosed
+		} else if c.rdOff < len(c.rdBuf) {
+			break
+		} else if c.err != nil {
+			err = c.err
+			c.mu.Unlock()
+			return 0, err
+		} else if c.rdEOF {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		deadline, changed := c.rdDeadline, c.changed
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			c.mu.Unlock()
+			return 0, ErrDeadlineExceeded
+		}
+
+		c.mu.Unlock()
+		waitChange(changed, &timer, deadline)
+		c.mu.Lock()
+	}
+
+	n = copy(b, c.rdBuf[c.rdOff:])
+	c.rdOff += n
+
+	resume := c.rdPaused && (len(c.rdBuf)-c.rdOff <= readLowWater)
+	if resume {
+		c.rdPaused = false
+	}
+	c.mu.Unlock()
+
+	if resume {
+		c.tc.Post(c.resumeRead)
+	}
+
+	return n, nil
+}
+
+// Write реализует net.Conn. Возвращает управление, когда все данные отправлены в сокет.
+// При истечении дедлайна данные, переданные воркеру, все равно будут отправлены
+func (c *Conn) Write(b []byte) (n int, err error) {
+	c.wrMu.Lock()
+	defer c.wrMu.Unlock()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, ErrClosed
+	} else if c.err != nil {
+		err = writeErr(c.err)
+		c.mu.Unlock()
+		return 0, err
+	} else if !c.wrDeadline.IsZero() && !time.Now().Before(c.wrDeadline) {
+		c.mu.Unlock()
+		return 0, ErrDeadlineExceeded
+	}
+	c.mu.Unlock()
+
+	data := append([]byte(nil), b...)
+	done := make(chan error, 1)
+	c.tc.Post(func() {
+		c.write(data, done)
+	})
+
+	var timer deadlineTimer
+	defer timer.stop()
+
+	for {
+		c.mu.Lock()
+		deadline, changed, closed := c.wrDeadline, c.changed, c.closed
+		c.mu.Unlock()
+
+		if closed {
+			return 0, ErrClosed
+		} else if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, ErrDeadlineExceeded
+		}
+
+		select {
+		case err = <-done:
+			if err != nil {
+				return 0, writeErr(err)
+			}
+			return len(b), nil
+		case <-changed:
+		case <-timer.wait(deadline):
+		}
+	}
+}
+
+// Close реализует net.Conn. Соединение закрывается после отправки уже переданных воркеру данных
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	c.notify()
+	c.mu.Unlock()
+
+	c.tc.CloseAfterFlush()
+	return nil
+}
+
+// LocalAddr реализует net.Conn
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr реализует net.Conn
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline реализует net.Conn
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdDeadline, c.wrDeadline = t, t
+	c.notify()
+	c.mu.Unlock()
+	return nil
+}
+
+// SetReadDeadline реализует net.Conn
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdDeadline = t
+	c.notify()
+	c.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline реализует net.Conn
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wrDeadline = t
+	c.notify()
+	c.mu.Unlock()
+	return nil
+}
+
+// notify будит всех, кто ждет изменений. Вызывается под c.mu
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// write передает данные Write в WrBuf. Выполняется в горутине воркера
+func (c *Conn) write(data []byte, done chan error) {
+	if c.workerClosed {
+		done <- c.closeErr()
+		return
+	}
+
+	if _, err := c.tc.Write(data); err != nil {
+		done <- err
+	} else if c.tc.WrBuf.Len() == 0 {
+		done <- nil
+	} else {
+		// остальное допишет воркер, см. onWrite
+		c.wrDone = done
+	}
+}
+
+// resumeRead возобновляет чтение из сокета после того, как Read разобрал накопившиеся данные.
+// Выполняется в горутине воркера
+func (c *Conn) resumeRead() {
+	c.mu.Lock()
+	paused := c.rdPaused
+	c.mu.Unlock()
+
+	// пока resumeRead ждал своей очереди, onRead мог снова приостановить чтение
+	if !c.workerClosed && !paused {
+		c.tc.ResumeRead()
+	}
+}
+
+func (c *Conn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// onRead забирает новые данные из RdBuf для Read
+func onRead(tc *gonetz.TCPConn) bool {
+	c, _ := tc.Context.(*Conn)
+	if c == nil {
+		// соединение не от Listener (например, TCPServer.Dial)
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		// после Close данные уже никто не прочитает
+		tc.RdBuf.Clean()
+		return true
+	}
+
+	// прочитанное Read место переиспользую
+	if c.rdOff > 0 {
+		c.rdBuf = c.rdBuf[:copy(c.rdBuf, c.rdBuf[c.rdOff:])]
+		c.rdOff = 0
+	}
+
+	start, size := len(c.rdBuf), tc.RdBuf.Len()
+	if cap(c.rdBuf)-start < size {
+		buf := make([]byte, start, 2*start+size)
+		copy(buf, c.rdBuf)
+		c.rdBuf = buf
+	}
+
+	n, _ := tc.Read(c.rdBuf[start : start+size])
+	c.rdBuf = c.rdBuf[:start+n]
+
+	if len(c.rdBuf) >= readHighWater {
+		c.rdPaused = true
+		tc.PauseRead()
+	}
+
+	c.notify()
+	return true
+}
+
+// onWrite завершает Write, данные которого не удалось отправить сразу
+func onWrite(tc *gonetz.TCPConn) bool {
+	if c, _ := tc.Context.(*Conn); (c != nil) && (c.wrDone != nil) {
+		c.wrDone <- nil
+		c.wrDone = nil
+	}
+	return true
+}
+
+// onEOF отдает Read io.EOF после уже полученных данных, а запись оставляет открытой до Close
+func onEOF(tc *gonetz.TCPConn) bool {
+	c, _ := tc.Context.(*Conn)
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	c.rdEOF = true
+	c.notify()
+	c.mu.Unlock()
+
+	return true
+}
+
+func onClose(tc *gonetz.TCPConn, reason gonetz.CloseReason) {
+	c, _ := tc.Context.(*Conn)
+	if c == nil {
+		// соединение было закрыто еще в onConnect
+		return
+	}
+	c.workerClosed = true
+
+	err := closeReasonErr(reason)
+
+	c.mu.Lock()
+	c.err = err
+	c.notify()
+	c.mu.Unlock()
+
+	if c.wrDone != nil {
+		c.wrDone <- err
+		c.wrDone = nil
+	}
+}
+
+// closeReasonErr возвращает ошибку, которую Read и Write отдают после закрытия соединения
+func closeReasonErr(reason gonetz.CloseReason) error {
+	switch reason {
+	case gonetz.CloseReasonEOF:
+		return io.EOF
+	case gonetz.CloseReasonReset:
+		return syscall.ECONNRESET
+	case gonetz.CloseReasonTimeout:
+		return ErrDeadlineExceeded
+	}
+	return ErrClosed
+}
+
+// writeErr заменяет io.EOF (другая сторона закрыла соединение) на ошибку, привычную для записи
+func writeErr(err error) error {
+	if err == io.EOF {
+		return syscall.EPIPE
+	}
+	return err
+}
+
+// waitChange ждет изменения состояния соединения, но не дольше deadline
+func waitChange(changed <-chan struct{}, timer *deadlineTimer, deadline time.Time) {
+	select {
+	case <-changed:
+	case <-timer.wait(deadline):
+	}
+}
+
+// wait возвращает канал, срабатывающий в deadline (nil для нулевого deadline, т.е. никогда).
+// Таймер пересоздается только при изменении deadline, так что пробуждения по notify новых таймеров не создают
+func (dt *deadlineTimer) wait(deadline time.Time) <-chan time.Time {
+	if !deadline.Equal(dt.deadline) {
+		dt.stop()
+		dt.deadline = deadline
+		if !deadline.IsZero() {
+			dt.timer = time.NewTimer(time.Until(deadline))
+		}
+	}
+
+	if dt.timer == nil {
+		return nil
+	}
+	return dt.timer.C
+}
+
+// stop останавливает таймер, чтобы он не жил до дедлайна после возврата из Read или Write
+func (dt *deadlineTimer) stop() {
+	if dt.timer != nil {
+		dt.timer.Stop()
+		dt.timer = nil
+	}
+}
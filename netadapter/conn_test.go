@@ -0,0 +1,161 @@
+package netadapter
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func acceptTestConn(t *testing.T, l *Listener) (server net.Conn, client net.Conn) {
+	client, err := net.DialTimeout(`tcp`, l.Addr().String(), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+
+	if server, err = l.Accept(); err != nil {
+		t.Fatalf(`Accept failed: %s`, err)
+	}
+
+	if server.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Fatalf(`RemoteAddr mismatch: %s != %s`, server.RemoteAddr(), client.LocalAddr())
+	}
+
+	return server, client
+}
+
+func Test_Conn_Echo(t *testing.T) {
+	srv, l := startTestServer(t)
+	defer srv.Close()
+
+	server, client := acceptTestConn(t, l)
+	defer client.Close()
+
+	go func() {
+		_, _ = io.Copy(server, server)
+		_ = server.Close()
+	}()
+
+	// заведомо больше буферов сокетов и readHighWater
+	data := make([]byte, 8*1024*1024)
+	rand.Read(data)
+
+	go func() {
+		_, _ = client.Write(data)
+	}()
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echo := make([]byte, len(data))
+	if _, err := io.ReadFull(client, echo); err != nil {
+		t.Fatalf(`Could not read echo: %s`, err)
+	} else if !bytes.Equal(echo, data) {
+		t.Fatalf(`echo mismatch`)
+	}
+}
+
+func Test_Conn_ReadDeadline(t *testing.T) {
+	srv, l := startTestServer(t)
+	defer srv.Close()
+
+	server, client := acceptTestConn(t, l)
+	defer client.Close()
+	defer server.Close()
+
+	_ = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	buf := make([]byte, 16)
+	if _, err := server.Read(buf); err == nil {
+		t.Fatalf(`Read without data succeeded`)
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf(`Read returned non-timeout error: %v`, err)
+	}
+
+	// после продления дедлайна Read снова работает
+	_ = server.SetReadDeadline(time.Time{})
+	if _, err := client.Write([]byte(`ping`)); err != nil {
+		t.Fatalf(`Could not write: %s`, err)
+	}
+
+	if n, err := server.Read(buf); err != nil {
+		t.Fatalf(`Read failed: %s`, err)
+	} else if string(buf[:n]) != `ping` {
+		t.Fatalf(`unexpected data: %q`, buf[:n])
+	}
+}
+
+func Test_Conn_EOF(t *testing.T) {
+	srv, l := startTestServer(t)
+	defer srv.Close()
+
+	server, client := acceptTestConn(t, l)
+	defer server.Close()
+
+	if _, err := client.Write([]byte(`bye`)); err != nil {
+		t.Fatalf(`Could not write: %s`, err)
+	}
+	_ = client.Close()
+
+	_ = server.SetReadDeadline(time.Now().Add(1 * time.Second))
+
+	// данные, пришедшие до закрытия, отдаются до io.EOF
+	data, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Fatalf(`ReadAll failed: %s`, err)
+	} else if string(data) != `bye` {
+		t.Fatalf(`unexpected data: %q`, data)
+	}
+
+	// как и у net.TCPConn, первая запись после FIN может пройти: о полном закрытии сообщит только RST
+	for deadline := time.Now().Add(1 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := server.Write([]byte(`late`)); err != nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf(`Write to closed connection succeeded`)
+		}
+	}
+}
+
+// Тест на половинчатое закрытие: клиент закрывает свою сторону после запроса и ждет ответа
+func Test_Conn_HalfClose(t *testing.T) {
+	srv, l := startTestServer(t)
+	defer srv.Close()
+
+	server, client := acceptTestConn(t, l)
+	defer client.Close()
+
+	resp := make([]byte, 4*1024*1024)
+	rand.Read(resp)
+
+	go func() {
+		defer server.Close()
+
+		_ = server.SetReadDeadline(time.Now().Add(1 * time.Second))
+		if req, err := ioutil.ReadAll(server); err != nil {
+			t.Errorf(`ReadAll failed: %s`, err)
+			return
+		} else if string(req) != `get` {
+			t.Errorf(`unexpected request: %q`, req)
+			return
+		}
+
+		if _, err := server.Write(resp); err != nil {
+			t.Errorf(`Write after client CloseWrite failed: %s`, err)
+		}
+	}()
+
+	if _, err := client.Write([]byte(`get`)); err != nil {
+		t.Fatalf(`Could not write: %s`, err)
+	} else if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf(`CloseWrite failed: %s`, err)
+	}
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if data, err := ioutil.ReadAll(client); err != nil {
+		t.Fatalf(`Could not read response: %s`, err)
+	} else if !bytes.Equal(data, resp) {
+		t.Fatalf(`response mismatch: expect len:%d got len:%d`, len(resp), len(data))
+	}
+}
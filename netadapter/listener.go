@@ -0,0 +1,105 @@
+// Package netadapter позволяет использовать gonetz с кодом, рассчитанным на net.Listener и net.Conn
+// (net/http, crypto/tls, grpc и т.д.).
+// Соединения по-прежнему обслуживаются воркерами gonetz, а блокирующие Read и Write ждут их обработчиков
+package netadapter
+
+import (
+	"net"
+	"sync"
+
+	"github.com/atercattus/gonetz"
+)
+
+const (
+	// acceptQueueSize - сколько установленных соединений может ждать Accept.
+	// Соединения сверх этого закрываются, как при переполнении listen backlog
+	acceptQueueSize = 1024
+)
+
+type (
+	// Listener реализует net.Listener поверх TCPServer
+	Listener struct {
+		srv *gonetz.TCPServer
+
+		accepted chan *Conn
+		done     chan struct{}
+		doneOnce sync.Once
+	}
+)
+
+// Listen занимает обработчики srv (OnClientConnect, OnClientRead, OnClientWrite, OnClientEOF, OnClientClose)
+// и возвращает Listener, выдающий соединения srv как net.Conn.
+// Запуск и остановка сервера (Start, Close, Shutdown) остаются за вызывающим кодом
+func Listen(srv *gonetz.TCPServer) *Listener {
+	l := &Listener{
+		srv:      srv,
+		accepted: make(chan *Conn, acceptQueueSize),
+		done:     make(chan struct{}),
+	}
+
+	srv.OnClientConnect(l.onConnect)
+	srv.OnClientRead(onRead)
+	srv.OnClientWrite(onWrite)
+	srv.OnClientEOF(onEOF)
+	srv.OnClientClose(onClose)
+
+	return l
+}
+
+// Accept реализует net.Listener
+func (l *Listener) Accept() (net.Conn, error) {
+	// после Close соединения из очереди уже не выдаю
+	select {
+	case <-l.done:
+		return nil, ErrClosed
+	default:
+	}
+
+	select {
+	case c := <-l.accepted:
+		return c, nil
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+// Close реализует net.Listener: Accept перестает выдавать соединения, а новые соединения закрываются.
+// Уже выданные соединения продолжают работать, сам сервер не останавливается
+func (l *Listener) Close() error {
+	l.doneOnce.Do(func() {
+		close(l.done)
+	})
+
+	// соединения, которые так и не дождались Accept
+	for {
+		select {
+		case c := <-l.accepted:
+			_ = c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Addr реализует net.Listener
+func (l *Listener) Addr() net.Addr {
+	return l.srv.Addr()
+}
+
+func (l *Listener) onConnect(tc *gonetz.TCPConn) bool {
+	select {
+	case <-l.done:
+		return false
+	default:
+	}
+
+	c := newConn(tc)
+
+	select {
+	case l.accepted <- c:
+		return true
+	default:
+		// никто не успевает забирать соединения
+		return false
+	}
+}
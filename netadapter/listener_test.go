@@ -0,0 +1,83 @@
+package netadapter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/atercattus/gonetz"
+)
+
+func startTestServer(t *testing.T) (*gonetz.TCPServer, *Listener) {
+	srv, err := gonetz.NewServerWithOptions(gonetz.ServerOptions{Host: `127.0.0.1`, Workers: 2})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	l := Listen(srv)
+
+	go func() {
+		if err := srv.Start(); err != nil {
+			t.Errorf(`Could not Start: %s`, err)
+		}
+	}()
+
+	return srv, l
+}
+
+func Test_Listener_HTTP(t *testing.T) {
+	srv, l := startTestServer(t)
+	defer srv.Close()
+
+	httpSrv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`hello ` + r.URL.Path))
+		}),
+	}
+	go func() {
+		_ = httpSrv.Serve(l)
+	}()
+	defer httpSrv.Close()
+
+	client := &http.Client{Timeout: 2 * time.Second}
+
+	// несколько запросов подряд идут по одному keep-alive соединению
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(`http://` + l.Addr().String() + `/gonetz`)
+		if err != nil {
+			t.Fatalf(`GET failed: %s`, err)
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf(`Could not read body: %s`, err)
+		} else if string(body) != `hello /gonetz` {
+			t.Fatalf(`unexpected body: %q`, body)
+		}
+	}
+}
+
+func Test_Listener_Close(t *testing.T) {
+	srv, l := startTestServer(t)
+	defer srv.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	_ = l.Close()
+
+	select {
+	case err := <-accepted:
+		if err == nil {
+			t.Fatalf(`Accept after Close returned connection`)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`Accept was not interrupted by Close`)
+	}
+}
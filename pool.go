@@ -0,0 +1,383 @@
+package gonetz
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type (
+	// PoolOptions - настройки пула исходящих соединений
+	PoolOptions struct {
+		// Size - количество прогретых соединений к каждому апстриму. По умолчанию 1
+		Size int
+		// DialTimeout - таймаут установки соединения. По умолчанию 1 секунда
+		DialTimeout time.Duration
+		// MinBackoff - пауза перед повторным подключением после первой неудачи. По умолчанию 100 мс
+		MinBackoff time.Duration
+		// MaxBackoff - максимальная пауза перед повторным подключением. По умолчанию 10 секунд
+		MaxBackoff time.Duration
+	}
+
+	// PoolHandler - обработчики одного обмена запрос/ответ по соединению из пула (см. Pool.Do).
+	// Все обработчики вызываются из горутины воркера соединения
+	PoolHandler struct {
+		// OnAcquire вызывается при выдаче соединения, в нем обычно пишется запрос
+		OnAcquire func(conn *TCPConn)
+		// OnRead вызывается при получении новых данных. Получив ответ целиком, нужно вызвать Pool.Release.
+		// false закрывает соединение
+		OnRead ConnEvent
+		// OnClose вызывается, если соединение закрылось до возврата в пул
+		OnClose CloseEvent
+	}
+
+	// Pool держит прогретые исходящие соединения к апстримам и выдает их для обменов запрос/ответ.
+	// Соединения живут в воркерах сервера, но обработчики сервера для них не вызываются.
+	// Сломанные соединения (EPOLLHUP/EPOLLERR, EOF, ошибки) выбрасываются из пула и переустанавливаются
+	// с экспоненциально растущей паузой после неудачных попыток
+	Pool struct {
+		srv  *TCPServer
+		opts PoolOptions
+
+		mu        sync.Mutex
+		closed    bool
+		upstreams map[string]*poolUpstream
+		conns     map[*TCPConn]*poolConn
+	}
+
+	poolUpstream struct {
+		pool    *Pool
+		address string
+
+		// поля ниже под pool.mu
+		idle     []*poolConn
+		busy     int // выданные соединения
+		dialing  int
+		failures int         // неудачных подключений подряд
+		retry    *time.Timer // отложенное переподключение
+	}
+
+	poolConn struct {
+		upstream *poolUpstream
+		conn     *TCPConn
+		idle     bool // лежит в upstream.idle, под pool.mu
+
+		// поля ниже меняются только в горутине воркера соединения
+		handler *PoolHandler // текущий обмен (nil - соединение свободно)
+		closed  bool
+		reason  CloseReason
+	}
+)
+
+var (
+	// ErrPoolExhausted - нет свободных соединений к апстриму
+	ErrPoolExhausted = fmt.Errorf(`no idle connections in pool`)
+	// ErrPoolUnknownUpstream - апстрим не был добавлен в пул
+	ErrPoolUnknownUpstream = fmt.Errorf(`unknown upstream`)
+	// ErrPoolClosed - пул закрыт
+	ErrPoolClosed = fmt.Errorf(`pool is closed`)
+)
+
+// NewPool создает пул исходящих соединений, обслуживаемых воркерами srv
+func NewPool(srv *TCPServer, opts PoolOptions) *Pool {
+	opts.setDefaults()
+
+	return &Pool{
+		srv:       srv,
+		opts:      opts,
+		upstreams: make(map[string]*poolUpstream),
+		conns:     make(map[*TCPConn]*poolConn),
+	}
+}
+
+func (opts *PoolOptions) setDefaults() {
+	if opts.Size < 1 {
+		opts.Size = 1
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 1 * time.Second
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 10 * time.Second
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+}
+
+// Add добавляет апстрим address (host:port) и начинает прогревать к нему соединения.
+// Повторное добавление ничего не делает
+func (p *Pool) Add(address string) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrPoolClosed
+	} else if _, ok := p.upstreams[address]; ok {
+		p.mu.Unlock()
+		return nil
+	}
+
+	upstream := &poolUpstream{pool: p, address: address}
+	p.upstreams[address] = upstream
+	p.mu.Unlock()
+
+	upstream.refill()
+
+	return nil
+}
+
+// Idle возвращает количество свободных соединений к апстриму
+func (p *Pool) Idle(address string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if upstream, ok := p.upstreams[address]; ok {
+		return len(upstream.idle)
+	}
+	return 0
+}
+
+// Do выдает свободное соединение к апстриму address для одного обмена запрос/ответ.
+// handler.OnAcquire вызывается из горутины воркера соединения, так что Do можно вызывать из любой горутины.
+// Обмен завершается вызовом Release (соединение возвращается в пул) или закрытием соединения
+func (p *Pool) Do(address string, handler PoolHandler) error {
+	p.mu.Lock()
+	upstream, ok := p.upstreams[address]
+	if p.closed {
+		p.mu.Unlock()
+		return ErrPoolClosed
+	} else if !ok {
+		p.mu.Unlock()
+		return ErrPoolUnknownUpstream
+	} else if len(upstream.idle) == 0 {
+		p.mu.Unlock()
+		return ErrPoolExhausted
+	}
+
+	last := len(upstream.idle) - 1
+	pc := upstream.idle[last]
+	upstream.idle[last] = nil
+	upstream.idle = upstream.idle[:last]
+	pc.idle = false
+	upstream.busy++
+	p.mu.Unlock()
+
+	pc.conn.worker.postFunc(func() {
+		pc.handler = &handler
+
+		if pc.closed {
+			// соединение успело закрыться, пока лежало в пуле
+			if handler.OnClose != nil {
+				handler.OnClose(pc.conn, pc.reason)
+			}
+			return
+		}
+
+		if handler.OnAcquire != nil {
+			handler.OnAcquire(pc.conn)
+		}
+	})
+
+	return nil
+}
+
+// Release возвращает соединение в пул после завершения обмена.
+// Вызывается из обработчиков PoolHandler (горутина воркера соединения)
+func (p *Pool) Release(conn *TCPConn) {
+	p.mu.Lock()
+	pc, ok := p.conns[conn]
+	if !ok || (pc.handler == nil) {
+		p.mu.Unlock()
+		return
+	}
+
+	pc.handler = nil
+
+	if mode, _ := conn.closeRequest(); p.closed || (mode != closeModeNone) || (conn.RdBuf.Len() > 0) {
+		// соединение закрывается или в нем остались лишние данные от апстрима.
+		// Из busy его уберет onClose
+		p.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+
+	pc.upstream.busy--
+	pc.idle = true
+	pc.upstream.idle = append(pc.upstream.idle, pc)
+	p.mu.Unlock()
+}
+
+// Close закрывает свободные соединения пула. Выданные соединения закрываются при возврате через Release
+func (p *Pool) Close() {
+	var idle []*poolConn
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+
+	for _, upstream := range p.upstreams {
+		if upstream.retry != nil {
+			upstream.retry.Stop()
+			upstream.retry = nil
+		}
+		idle = append(idle, upstream.idle...)
+		upstream.idle = nil
+	}
+	p.mu.Unlock()
+
+	for _, pc := range idle {
+		_ = pc.conn.Close()
+	}
+}
+
+// refill дозапускает подключения до PoolOptions.Size, если не ждет паузы после неудачи
+// и сервер еще не остановлен
+func (u *poolUpstream) refill() {
+	p := u.pool
+
+	p.mu.Lock()
+	if p.closed || (u.retry != nil) || p.srvStopped() {
+		p.mu.Unlock()
+		return
+	}
+
+	need := p.opts.Size - (len(u.idle) + u.busy + u.dialing)
+	if need < 0 {
+		need = 0
+	}
+	u.dialing += need
+	p.mu.Unlock()
+
+	// Dial может сразу же вызвать обработчик, так что вызываю без блокировки
+	for i := 0; i < need; i++ {
+		if err := p.srv.Dial(u.address, p.opts.DialTimeout, u.dialed); err != nil {
+			u.dialed(nil, err)
+		}
+	}
+}
+
+// dialed - DialEvent для соединений пула
+func (u *poolUpstream) dialed(conn *TCPConn, err error) {
+	p := u.pool
+
+	if err != nil {
+		p.mu.Lock()
+		u.dialing--
+		u.failures++
+		// после остановки сервера Dial все равно не сможет подключиться (ErrServerClosed, ErrDialAborted)
+		if !p.closed && (u.retry == nil) && !p.srvStopped() {
+			u.retry = time.AfterFunc(u.backoff(), u.retryRefill)
+		}
+		p.mu.Unlock()
+		return
+	}
+
+	pc := &poolConn{upstream: u, conn: conn}
+	conn.rdEvent = pc.onRead
+	conn.wrEvent = pc.onWrite
+	conn.wlEvent = pc.onWrite
+	conn.efEvent = pc.onEOF
+	conn.clEvent = pc.onClose
+
+	p.mu.Lock()
+	u.dialing--
+	u.failures = 0
+	pc.idle = true // чтобы onClose не трогал busy
+	if p.closed {
+		p.mu.Unlock()
+		_ = conn.Close()
+		return
+	}
+	p.conns[conn] = pc
+	u.idle = append(u.idle, pc)
+	p.mu.Unlock()
+}
+
+// backoff возвращает паузу перед следующим подключением. Вызывается под pool.mu
+func (u *poolUpstream) backoff() time.Duration {
+	opts := &u.pool.opts
+
+	delay := opts.MinBackoff
+	for i := 1; (i < u.failures) && (delay < opts.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if delay > opts.MaxBackoff {
+		delay = opts.MaxBackoff
+	}
+	return delay
+}
+
+// srvStopped сообщает, что сервер пула остановлен (Close или Shutdown), так что переподключаться бессмысленно
+func (p *Pool) srvStopped() bool {
+	return p.srv.isClosed() || p.srv.isShuttingDown()
+}
+
+func (u *poolUpstream) retryRefill() {
+	u.pool.mu.Lock()
+	u.retry = nil
+	u.pool.mu.Unlock()
+
+	u.refill()
+}
+
+// onRead - обработчик чтения соединения пула
+func (pc *poolConn) onRead(conn *TCPConn) bool {
+	if pc.handler == nil {
+		// апстрим прислал что-то без запроса, такому соединению доверять уже нельзя
+		return false
+	} else if pc.handler.OnRead == nil {
+		return true
+	}
+	return pc.handler.OnRead(conn)
+}
+
+// onWrite - обработчик записи соединения пула (OnClientWrite и OnClientWriteLowWater): обмену он не нужен,
+// а обработчики сервера для соединений пула вызываться не должны
+func (pc *poolConn) onWrite(conn *TCPConn) bool {
+	return true
+}
+
+// onEOF - обработчик FIN от апстрима: такое соединение в пул уже не вернется, так что оно закрывается
+func (pc *poolConn) onEOF(conn *TCPConn) bool {
+	return false
+}
+
+// onClose выбрасывает закрытое соединение из пула и запускает переподключение
+func (pc *poolConn) onClose(conn *TCPConn, reason CloseReason) {
+	u := pc.upstream
+	p := u.pool
+
+	pc.closed, pc.reason = true, reason
+
+	p.mu.Lock()
+	delete(p.conns, conn)
+	if !pc.idle {
+		// выдано через Do (возможно, OnAcquire еще не вызван)
+		u.busy--
+	} else {
+		for i, idle := range u.idle {
+			if idle == pc {
+				u.idle = append(u.idle[:i], u.idle[i+1:]...)
+				break
+			}
+		}
+		pc.idle = false
+	}
+	p.mu.Unlock()
+
+	if handler := pc.handler; handler != nil {
+		pc.handler = nil
+		if handler.OnClose != nil {
+			handler.OnClose(conn, reason)
+		}
+	}
+
+	// Dial резолвит адрес синхронно, и для апстрима с именем хоста это остановило бы все соединения воркера
+	go u.refill()
+}
@@ -0,0 +1,315 @@
+package gonetz
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func waitPoolIdle(t *testing.T, pool *Pool, address string, exp int) {
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+		if pool.Idle(address) == exp {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf(`pool idle connections mismatch: expect %d got %d`, exp, pool.Idle(address))
+}
+
+// upstream для тестов: echo сервер, отдающий принятые соединения в accepted
+func startPoolUpstream(t *testing.T) (ln net.Listener, accepted chan net.Conn) {
+	ln, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf(`Could not listen: %s`, err)
+	}
+
+	accepted = make(chan net.Conn, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+			go func() {
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln, accepted
+}
+
+func Test_Pool_Do(t *testing.T) {
+	ln, _ := startPoolUpstream(t)
+	defer ln.Close()
+	address := ln.Addr().String()
+
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 2})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+	defer stopTestServer(srv)
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		t.Errorf(`server OnClientRead was called for pool connection`)
+		return true
+	})
+
+	pool := NewPool(srv, PoolOptions{Size: 2})
+	defer pool.Close()
+
+	if err := pool.Do(address, PoolHandler{}); err != ErrPoolUnknownUpstream {
+		t.Fatalf(`Do for unknown upstream returned wrong error: %v`, err)
+	}
+
+	if err := pool.Add(address); err != nil {
+		t.Fatalf(`Add failed: %s`, err)
+	}
+	waitPoolIdle(t, pool, address, 2)
+
+	req := []byte(`ping`)
+	responses := make(chan string, 2)
+
+	handler := PoolHandler{
+		OnAcquire: func(conn *TCPConn) {
+			_, _ = conn.Write(req)
+		},
+		OnRead: func(conn *TCPConn) bool {
+			if conn.RdBuf.Len() < len(req) {
+				return true
+			}
+			buf := make([]byte, len(req))
+			n, _ := conn.Read(buf)
+			pool.Release(conn)
+			responses <- string(buf[:n])
+			return true
+		},
+		OnClose: func(conn *TCPConn, reason CloseReason) {
+			t.Errorf(`pool connection was closed during exchange: %s`, reason)
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := pool.Do(address, handler); err != nil {
+			t.Fatalf(`Do failed: %s`, err)
+		}
+	}
+
+	if err := pool.Do(address, handler); err != ErrPoolExhausted {
+		t.Fatalf(`Do without idle connections returned wrong error: %v`, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case resp := <-responses:
+			if resp != string(req) {
+				t.Fatalf(`response mismatch: %q`, resp)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf(`no response from upstream`)
+		}
+	}
+
+	waitPoolIdle(t, pool, address, 2)
+
+	pool.Close()
+	if err := pool.Do(address, handler); err != ErrPoolClosed {
+		t.Fatalf(`Do after Close returned wrong error: %v`, err)
+	}
+}
+
+// Тест на выбрасывание из пула соединений, закрытых апстримом, и переподключение
+func Test_Pool_Evict(t *testing.T) {
+	ln, accepted := startPoolUpstream(t)
+	defer ln.Close()
+	address := ln.Addr().String()
+
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+	defer stopTestServer(srv)
+
+	pool := NewPool(srv, PoolOptions{Size: 1})
+	defer pool.Close()
+
+	if err := pool.Add(address); err != nil {
+		t.Fatalf(`Add failed: %s`, err)
+	}
+	waitPoolIdle(t, pool, address, 1)
+
+	first := <-accepted
+	_ = first.Close()
+
+	// новое соединение взамен закрытого
+	select {
+	case second := <-accepted:
+		defer second.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatalf(`pool did not reconnect after upstream close`)
+	}
+	waitPoolIdle(t, pool, address, 1)
+}
+
+// Тест на переподключение после неудачных попыток
+func Test_Pool_Backoff(t *testing.T) {
+	ln, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf(`Could not listen: %s`, err)
+	}
+	address := ln.Addr().String()
+	_ = ln.Close() // пока никто не слушает
+
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+	defer stopTestServer(srv)
+
+	pool := NewPool(srv, PoolOptions{Size: 1, MinBackoff: 10 * time.Millisecond, MaxBackoff: 40 * time.Millisecond})
+	defer pool.Close()
+
+	upstream := &poolUpstream{pool: pool}
+	for failures, exp := range []time.Duration{10, 10, 20, 40, 40, 40} {
+		upstream.failures = failures
+		if got := upstream.backoff(); got != exp*time.Millisecond {
+			t.Fatalf(`backoff for %d failures: expect %s got %s`, failures, exp*time.Millisecond, got)
+		}
+	}
+
+	if err := pool.Add(address); err != nil {
+		t.Fatalf(`Add failed: %s`, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if got := pool.Idle(address); got != 0 {
+		t.Fatalf(`pool has %d idle connections to closed port`, got)
+	}
+
+	ln, err = net.Listen(`tcp`, address)
+	if err != nil {
+		t.Skipf(`Could not listen on the same address again: %s`, err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	waitPoolIdle(t, pool, address, 1)
+}
+
+// Тест на прекращение переподключений после остановки сервера
+func Test_Pool_ServerStopped(t *testing.T) {
+	ln, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf(`Could not listen: %s`, err)
+	}
+	address := ln.Addr().String()
+	_ = ln.Close() // никто не слушает, так что пул переподключается постоянно
+
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	pool := NewPool(srv, PoolOptions{Size: 1, MinBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+	defer pool.Close()
+
+	if err := pool.Add(address); err != nil {
+		t.Fatalf(`Add failed: %s`, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	stopTestServer(srv)
+	time.Sleep(50 * time.Millisecond) // уже запланированное переподключение
+
+	upstream := pool.upstreams[address]
+	failures := func() (int, bool) {
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		return upstream.failures, upstream.retry != nil
+	}
+
+	before, _ := failures()
+	time.Sleep(100 * time.Millisecond)
+
+	if after, retry := failures(); after != before {
+		t.Fatalf(`pool keeps dialing after server stop: %d failures, expect %d`, after, before)
+	} else if retry {
+		t.Fatalf(`pool has scheduled reconnect after server stop`)
+	}
+}
+
+// Тест на то, что обработчики записи сервера не вызываются для соединений пула
+func Test_Pool_ServerWriteHandlers(t *testing.T) {
+	ln, _ := startPoolUpstream(t)
+	defer ln.Close()
+	address := ln.Addr().String()
+
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+	defer stopTestServer(srv)
+
+	srv.OnClientWrite(func(conn *TCPConn) bool {
+		t.Errorf(`server OnClientWrite was called for pool connection`)
+		return false
+	})
+	srv.OnClientWriteLowWater(func(conn *TCPConn) bool {
+		t.Errorf(`server OnClientWriteLowWater was called for pool connection`)
+		return false
+	})
+
+	pool := NewPool(srv, PoolOptions{Size: 1})
+	defer pool.Close()
+
+	if err := pool.Add(address); err != nil {
+		t.Fatalf(`Add failed: %s`, err)
+	}
+	waitPoolIdle(t, pool, address, 1)
+
+	// запрос не влезает в буфер сокета, так что досылается по EPOLLOUT
+	req := make([]byte, 8*1024*1024)
+	done := make(chan struct{})
+
+	handler := PoolHandler{
+		OnAcquire: func(conn *TCPConn) {
+			conn.SetWriteBufferLimit(2*len(req), 1024)
+			_, _ = conn.Write(req)
+		},
+		OnRead: func(conn *TCPConn) bool {
+			if conn.RdBuf.Len() < len(req) {
+				return true
+			}
+			conn.RdBuf.Discard(len(req))
+			pool.Release(conn)
+			close(done)
+			return true
+		},
+		OnClose: func(conn *TCPConn, reason CloseReason) {
+			t.Errorf(`pool connection was closed during exchange: %s`, reason)
+		},
+	}
+
+	if err := pool.Do(address, handler); err != nil {
+		t.Fatalf(`Do failed: %s`, err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf(`no response from upstream`)
+	}
+
+	waitPoolIdle(t, pool, address, 1)
+}
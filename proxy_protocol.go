@@ -0,0 +1,314 @@
+package gonetz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type (
+	// ProxyProtocolMode - режим разбора заголовка PROXY protocol (см. ServerOptions.ProxyProtocol)
+	ProxyProtocolMode int
+
+	// ProxyHeader - заголовок PROXY protocol, полученный в начале соединения (см. TCPConn.ProxyHeader)
+	ProxyHeader struct {
+		// Version - 1 (текстовый заголовок) или 2 (бинарный)
+		Version int
+		// Local - соединение установил сам балансировщик (например, health check), адреса клиента нет
+		Local bool
+		// Source и Destination - адреса клиента и сервера, к которому клиент подключался.
+		// nil, если балансировщик их не передал (UNKNOWN, AF_UNSPEC, LOCAL, UDP)
+		Source      net.Addr
+		Destination net.Addr
+		// TLVs - дополнительные поля заголовка v2 в порядке следования
+		TLVs []ProxyTLV
+	}
+
+	// ProxyTLV - дополнительное поле заголовка PROXY protocol v2 (type-length-value)
+	ProxyTLV struct {
+		Type  byte
+		Value []byte
+	}
+)
+
+const (
+	// ProxyProtocolOff - PROXY protocol не используется (по умолчанию)
+	ProxyProtocolOff ProxyProtocolMode = iota
+	// ProxyProtocolOptional - заголовок разбирается, если он есть, а иначе данные передаются обработчикам как есть.
+	// Соединения с некорректным заголовком закрываются и в этом режиме
+	ProxyProtocolOptional
+	// ProxyProtocolStrict - соединения без корректного заголовка закрываются
+	ProxyProtocolStrict
+)
+
+// Типы TLV PROXY protocol v2
+const (
+	ProxyTLVALPN      = 0x01
+	ProxyTLVAuthority = 0x02
+	ProxyTLVCRC32C    = 0x03
+	ProxyTLVNoop      = 0x04
+	ProxyTLVUniqueID  = 0x05
+	ProxyTLVSSL       = 0x20
+	ProxyTLVNetNS     = 0x30
+	// ProxyTLVAWS - VPC endpoint id от AWS NLB
+	ProxyTLVAWS = 0xEA
+)
+
+const (
+	// proxyV1MaxLen - максимальная длина текстового заголовка вместе с \r\n
+	proxyV1MaxLen = 107
+	// proxyV2HeaderLen - длина фиксированной части бинарного заголовка (сигнатура, версия, семейство, длина)
+	proxyV2HeaderLen = 16
+	// proxyMaxHeaderLen - максимальная длина заголовка любой версии
+	proxyMaxHeaderLen = proxyV2HeaderLen + 0xFFFF
+)
+
+var (
+	proxyV1Sig = []byte(`PROXY `)
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	proxyCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errProxyMalformed = fmt.Errorf(`malformed proxy protocol header`)
+	errProxyMissing   = fmt.Errorf(`no proxy protocol header`)
+)
+
+// ProxyHeader возвращает заголовок PROXY protocol соединения или nil, если его не было
+// (PROXY protocol выключен или в режиме ProxyProtocolOptional клиент подключился напрямую)
+func (conn *TCPConn) ProxyHeader() *ProxyHeader {
+	return conn.proxyHeader
+}
+
+// TLV возвращает значение первого поля заголовка с типом typ (nil, если такого поля нет)
+func (hdr *ProxyHeader) TLV(typ byte) []byte {
+	for _, tlv := range hdr.TLVs {
+		if tlv.Type == typ {
+			return tlv.Value
+		}
+	}
+	return nil
+}
+
+// readProxyHeader разбирает заголовок PROXY protocol в начале RdBuf. Вызывается из readClient, пока заголовок
+// не получен. После заголовка соединение передается обработчикам (см. connectConn).
+// Возвращает true, если в RdBuf остались данные для OnClientRead
+func (w *tcpWorker) readProxyHeader(conn *TCPConn) bool {
+	size := conn.RdBuf.Len()
+	if size > proxyMaxHeaderLen {
+		size = proxyMaxHeaderLen
+	}
+	buf := make([]byte, size)
+	conn.RdBuf.peek(buf)
+
+	hdr, n, err := parseProxyHeader(buf)
+	if (err == errProxyMissing) && (w.srv.options.ProxyProtocol == ProxyProtocolOptional) {
+		// клиент подключился напрямую
+	} else if err != nil {
+		atomic.AddUint64(&w.srv.rejected, 1)
+		conn.requestClose(closeModeAbort, CloseReasonError)
+		return false
+	} else if hdr == nil {
+		// заголовок получен не полностью
+		return false
+	} else {
+		conn.RdBuf.Discard(n)
+		conn.proxyHeader = hdr
+		if hdr.Source != nil {
+			conn.remoteAddr = hdr.Source
+		}
+		if hdr.Destination != nil {
+			conn.localAddr = hdr.Destination
+		}
+	}
+
+	conn.proxyPending = false
+	return w.connectConn(conn)
+}
+
+// parseProxyHeader разбирает заголовок PROXY protocol в начале buf и возвращает его длину n.
+// Если данных для разбора пока недостаточно, то возвращает nil hdr без ошибки.
+// errProxyMissing означает, что buf начинается не с заголовка
+func parseProxyHeader(buf []byte) (hdr *ProxyHeader, n int, err error) {
+	if bytes.HasPrefix(buf, proxyV2Sig) {
+		return parseProxyV2(buf)
+	} else if bytes.HasPrefix(buf, proxyV1Sig) {
+		return parseProxyV1(buf)
+	} else if bytes.HasPrefix(proxyV2Sig, buf) || bytes.HasPrefix(proxyV1Sig, buf) {
+		return nil, 0, nil
+	}
+	return nil, 0, errProxyMissing
+}
+
+// parseProxyV1 разбирает текстовый заголовок: "PROXY TCP4 src dst sport dport\r\n" (TCP6 или UNKNOWN)
+func parseProxyV1(buf []byte) (hdr *ProxyHeader, n int, err error) {
+	line := buf
+	if len(line) > proxyV1MaxLen {
+		line = line[:proxyV1MaxLen]
+	}
+
+	end := bytes.Index(line, []byte("\r\n"))
+	if end == -1 {
+		if len(buf) >= proxyV1MaxLen {
+			return nil, 0, errProxyMalformed
+		}
+		return nil, 0, nil
+	}
+
+	hdr = &ProxyHeader{Version: 1}
+	fields := strings.Split(string(buf[:end]), ` `)
+
+	if (len(fields) >= 2) && (fields[1] == `UNKNOWN`) {
+		// остаток строки по спецификации игнорируется
+		return hdr, end + 2, nil
+	} else if len(fields) != 6 {
+		return nil, 0, errProxyMalformed
+	}
+
+	var v6 bool
+	switch fields[1] {
+	case `TCP4`:
+	case `TCP6`:
+		v6 = true
+	default:
+		return nil, 0, errProxyMalformed
+	}
+
+	if hdr.Source, err = parseProxyV1Addr(fields[2], fields[4], v6); err != nil {
+		return nil, 0, err
+	} else if hdr.Destination, err = parseProxyV1Addr(fields[3], fields[5], v6); err != nil {
+		return nil, 0, err
+	}
+
+	return hdr, end + 2, nil
+}
+
+func parseProxyV1Addr(host, port string, v6 bool) (net.Addr, error) {
+	ip := net.ParseIP(host)
+	if (ip == nil) || (strings.IndexByte(host, ':') != -1) != v6 {
+		return nil, errProxyMalformed
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errProxyMalformed
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// parseProxyV2 разбирает бинарный заголовок: сигнатура, версия и команда, семейство и протокол,
+// длина остатка, адреса, TLV
+func parseProxyV2(buf []byte) (hdr *ProxyHeader, n int, err error) {
+	if len(buf) < proxyV2HeaderLen {
+		return nil, 0, nil
+	}
+
+	verCmd, family := buf[12], buf[13]
+	if verCmd>>4 != 2 {
+		return nil, 0, errProxyMalformed
+	}
+
+	n = proxyV2HeaderLen + int(binary.BigEndian.Uint16(buf[14:16]))
+	if len(buf) < n {
+		return nil, 0, nil
+	}
+
+	hdr = &ProxyHeader{Version: 2}
+	switch verCmd & 0x0F {
+	case 0x00:
+		hdr.Local = true
+	case 0x01:
+	default:
+		return nil, 0, errProxyMalformed
+	}
+
+	var addrLen int
+	switch family >> 4 {
+	case 0x00: // AF_UNSPEC
+	case 0x01: // AF_INET
+		addrLen = 2*net.IPv4len + 4
+	case 0x02: // AF_INET6
+		addrLen = 2*net.IPv6len + 4
+	case 0x03: // AF_UNIX
+		addrLen = 2 * 108
+	default:
+		return nil, 0, errProxyMalformed
+	}
+
+	if (family & 0x0F) > 0x02 {
+		return nil, 0, errProxyMalformed
+	} else if n-proxyV2HeaderLen < addrLen {
+		return nil, 0, errProxyMalformed
+	}
+
+	// buf - временный буфер, а TLV остаются доступными через ProxyHeader
+	payload := append([]byte(nil), buf[proxyV2HeaderLen:n]...)
+
+	// для LOCAL адреса по спецификации игнорируются, а UDP соединения здесь не бывает
+	if !hdr.Local && (family&0x0F == 0x01) {
+		hdr.Source, hdr.Destination = parseProxyV2Addrs(family>>4, payload[:addrLen])
+	}
+
+	crcOffset := -1
+	for tlvs := payload[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, 0, errProxyMalformed
+		}
+
+		size := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+size {
+			return nil, 0, errProxyMalformed
+		}
+
+		tlv := ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+size]}
+		if (tlv.Type == ProxyTLVCRC32C) && (size == 4) && (crcOffset == -1) {
+			crcOffset = n - len(tlvs) + 3
+		}
+		hdr.TLVs = append(hdr.TLVs, tlv)
+
+		tlvs = tlvs[3+size:]
+	}
+
+	if (crcOffset != -1) && !checkProxyCRC(buf[:n], crcOffset) {
+		return nil, 0, errProxyMalformed
+	}
+
+	return hdr, n, nil
+}
+
+func parseProxyV2Addrs(af byte, addrs []byte) (src, dst net.Addr) {
+	switch af {
+	case 0x01:
+		ports := addrs[2*net.IPv4len:]
+		return &net.TCPAddr{IP: net.IPv4(addrs[0], addrs[1], addrs[2], addrs[3]), Port: int(binary.BigEndian.Uint16(ports))},
+			&net.TCPAddr{IP: net.IPv4(addrs[4], addrs[5], addrs[6], addrs[7]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+
+	case 0x02:
+		ports := addrs[2*net.IPv6len:]
+		return &net.TCPAddr{IP: net.IP(addrs[:net.IPv6len]), Port: int(binary.BigEndian.Uint16(ports))},
+			&net.TCPAddr{IP: net.IP(addrs[net.IPv6len : 2*net.IPv6len]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+
+	case 0x03:
+		// пути дополнены нулями до 108 байт
+		return &net.UnixAddr{Name: unixPathName(bytes.TrimRight(addrs[:108], "\x00")), Net: `unix`},
+			&net.UnixAddr{Name: unixPathName(bytes.TrimRight(addrs[108:], "\x00")), Net: `unix`}
+	}
+
+	return nil, nil
+}
+
+// checkProxyCRC проверяет CRC32c заголовка, в котором значение контрольной суммы находится по смещению crcOffset
+func checkProxyCRC(header []byte, crcOffset int) bool {
+	expected := binary.BigEndian.Uint32(header[crcOffset:])
+
+	// контрольная сумма считается по заголовку с обнуленным значением самой контрольной суммы
+	tmp := append([]byte(nil), header...)
+	copy(tmp[crcOffset:crcOffset+4], []byte{0, 0, 0, 0})
+
+	return crc32.Checksum(tmp, proxyCRCTable) == expected
+}
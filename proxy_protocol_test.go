@@ -0,0 +1,298 @@
+package gonetz
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"testing"
+	"time"
+)
+
+// buildProxyV2 собирает бинарный заголовок. Если withCRC, то в конец добавляется TLV с контрольной суммой
+func buildProxyV2(cmd, family byte, addrs []byte, tlvs []ProxyTLV, withCRC bool) []byte {
+	var body []byte
+	body = append(body, addrs...)
+	for _, tlv := range tlvs {
+		body = append(body, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+		body = append(body, tlv.Value...)
+	}
+	if withCRC {
+		body = append(body, ProxyTLVCRC32C, 0, 4, 0, 0, 0, 0)
+	}
+
+	hdr := append([]byte(nil), proxyV2Sig...)
+	hdr = append(hdr, 0x20|cmd, family, byte(len(body)>>8), byte(len(body)))
+	hdr = append(hdr, body...)
+
+	if withCRC {
+		binary.BigEndian.PutUint32(hdr[len(hdr)-4:], crc32.Checksum(hdr, crc32.MakeTable(crc32.Castagnoli)))
+	}
+	return hdr
+}
+
+func Test_parseProxyHeader_V1(t *testing.T) {
+	tests := []struct {
+		in       string
+		n        int
+		src, dst string
+		err      error
+	}{
+		{in: "PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\nGET", n: 43, src: `192.168.0.1:56324`, dst: `10.0.0.1:443`},
+		{in: "PROXY TCP6 2001:db8::1 ::1 4000 80\r\n", n: 36, src: `[2001:db8::1]:4000`, dst: `[::1]:80`},
+		{in: "PROXY UNKNOWN ff:: ::1 1 2\r\n", n: 28},
+		{in: "PROXY UNKNOWN\r\n", n: 15},
+		{in: "PROXY TCP4 192.168.0.1 10.0.0.1 56324"},
+		{in: "PRO"},
+		{in: ""},
+		{in: "PROXY TCP4 ::1 10.0.0.1 1 2\r\n", err: errProxyMalformed},
+		{in: "PROXY TCP6 10.0.0.2 10.0.0.1 1 2\r\n", err: errProxyMalformed},
+		{in: "PROXY TCP4 10.0.0.2 10.0.0.1 1 65536\r\n", err: errProxyMalformed},
+		{in: "PROXY TCP4 10.0.0.2 10.0.0.1 1\r\n", err: errProxyMalformed},
+		{in: "PROXY UDP4 10.0.0.2 10.0.0.1 1 2\r\n", err: errProxyMalformed},
+		{in: "PROXY " + string(bytes.Repeat([]byte(`x`), proxyV1MaxLen)), err: errProxyMalformed},
+		{in: "GET / HTTP/1.1\r\n", err: errProxyMissing},
+	}
+
+	for _, tt := range tests {
+		hdr, n, err := parseProxyHeader([]byte(tt.in))
+		if err != tt.err {
+			t.Fatalf(`%q: expect error %v got %v`, tt.in, tt.err, err)
+		} else if n != tt.n {
+			t.Fatalf(`%q: expect length %d got %d`, tt.in, tt.n, n)
+		} else if (err != nil) || (n == 0) {
+			continue
+		}
+
+		if hdr.Version != 1 {
+			t.Fatalf(`%q: wrong version %d`, tt.in, hdr.Version)
+		} else if tt.src == `` {
+			if (hdr.Source != nil) || (hdr.Destination != nil) {
+				t.Fatalf(`%q: addresses must be empty`, tt.in)
+			}
+		} else if (hdr.Source.String() != tt.src) || (hdr.Destination.String() != tt.dst) {
+			t.Fatalf(`%q: wrong addresses %s -> %s`, tt.in, hdr.Source, hdr.Destination)
+		}
+	}
+}
+
+func Test_parseProxyHeader_V2(t *testing.T) {
+	addrs4 := []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xDC, 0x04, 0x01, 0xBB}
+	tlvs := []ProxyTLV{
+		{Type: ProxyTLVALPN, Value: []byte(`h2`)},
+		{Type: ProxyTLVAWS, Value: []byte("\x01vpce-0123")},
+	}
+
+	full := buildProxyV2(0x01, 0x11, addrs4, tlvs, true)
+	hdr, n, err := parseProxyHeader(append(full, `payload`...))
+	if err != nil {
+		t.Fatalf(`v2 TCP4 failed: %s`, err)
+	} else if n != len(full) {
+		t.Fatalf(`v2 TCP4: expect length %d got %d`, len(full), n)
+	} else if (hdr.Version != 2) || hdr.Local {
+		t.Fatalf(`v2 TCP4: wrong version or command`)
+	} else if (hdr.Source.String() != `192.168.0.1:56324`) || (hdr.Destination.String() != `10.0.0.1:443`) {
+		t.Fatalf(`v2 TCP4: wrong addresses %s -> %s`, hdr.Source, hdr.Destination)
+	} else if len(hdr.TLVs) != 3 {
+		t.Fatalf(`v2 TCP4: expect 3 TLVs got %d`, len(hdr.TLVs))
+	} else if (string(hdr.TLV(ProxyTLVALPN)) != `h2`) || (string(hdr.TLV(ProxyTLVAWS)) != "\x01vpce-0123") {
+		t.Fatalf(`v2 TCP4: wrong TLV values`)
+	} else if hdr.TLV(ProxyTLVUniqueID) != nil {
+		t.Fatalf(`v2 TCP4: unexpected TLV`)
+	}
+
+	// данных пока недостаточно
+	for _, size := range []int{5, proxyV2HeaderLen - 1, len(full) - 1} {
+		if hdr, n, err := parseProxyHeader(full[:size]); (hdr != nil) || (n != 0) || (err != nil) {
+			t.Fatalf(`v2 partial (%d bytes) must wait for more data`, size)
+		}
+	}
+
+	addrs6 := make([]byte, 36)
+	copy(addrs6, net.ParseIP(`2001:db8::1`))
+	copy(addrs6[16:], net.ParseIP(`::1`))
+	binary.BigEndian.PutUint16(addrs6[32:], 4000)
+	binary.BigEndian.PutUint16(addrs6[34:], 80)
+	if hdr, _, err := parseProxyHeader(buildProxyV2(0x01, 0x21, addrs6, nil, false)); err != nil {
+		t.Fatalf(`v2 TCP6 failed: %s`, err)
+	} else if (hdr.Source.String() != `[2001:db8::1]:4000`) || (hdr.Destination.String() != `[::1]:80`) {
+		t.Fatalf(`v2 TCP6: wrong addresses %s -> %s`, hdr.Source, hdr.Destination)
+	}
+
+	addrsUnix := make([]byte, 216)
+	copy(addrsUnix, `/run/client.sock`)
+	copy(addrsUnix[109:], `server`) // abstract namespace
+	if hdr, _, err := parseProxyHeader(buildProxyV2(0x01, 0x31, addrsUnix, nil, false)); err != nil {
+		t.Fatalf(`v2 UNIX failed: %s`, err)
+	} else if (hdr.Source.String() != `/run/client.sock`) || (hdr.Destination.String() != `@server`) {
+		t.Fatalf(`v2 UNIX: wrong addresses %s -> %s`, hdr.Source, hdr.Destination)
+	}
+
+	// LOCAL: адреса игнорируются
+	if hdr, _, err := parseProxyHeader(buildProxyV2(0x00, 0x11, addrs4, nil, false)); err != nil {
+		t.Fatalf(`v2 LOCAL failed: %s`, err)
+	} else if !hdr.Local || (hdr.Source != nil) || (hdr.Destination != nil) {
+		t.Fatalf(`v2 LOCAL: wrong header %+v`, hdr)
+	}
+
+	// UDP: адреса не подменяются
+	if hdr, _, err := parseProxyHeader(buildProxyV2(0x01, 0x12, addrs4, nil, false)); err != nil {
+		t.Fatalf(`v2 UDP failed: %s`, err)
+	} else if hdr.Source != nil {
+		t.Fatalf(`v2 UDP: addresses must be empty`)
+	}
+
+	malformed := map[string][]byte{
+		`version`:     append(append([]byte(nil), proxyV2Sig...), 0x11, 0x11, 0, 0),
+		`command`:     buildProxyV2(0x02, 0x11, addrs4, nil, false),
+		`family`:      buildProxyV2(0x01, 0x41, addrs4, nil, false),
+		`short addrs`: buildProxyV2(0x01, 0x21, addrs4, nil, false),
+		`truncated tlv`: append(buildProxyV2(0x01, 0x11, addrs4, nil, false)[:proxyV2HeaderLen-2], 0, 14,
+			192, 168, 0, 1, 10, 0, 0, 1, 0xDC, 0x04, 0x01, 0xBB, ProxyTLVNoop, 0),
+	}
+
+	badCRC := buildProxyV2(0x01, 0x11, addrs4, tlvs, true)
+	badCRC[len(badCRC)-1] ^= 0xFF
+	malformed[`crc`] = badCRC
+
+	for name, buf := range malformed {
+		if _, _, err := parseProxyHeader(buf); err != errProxyMalformed {
+			t.Fatalf(`v2 %s: expect malformed error got %v`, name, err)
+		}
+	}
+}
+
+func startProxyServer(t *testing.T, opts ServerOptions) (srv *TCPServer, addr string, events chan string, stop func()) {
+	srv, addr = newTestServer(t, opts)
+
+	events = make(chan string, 16)
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		events <- `connect ` + conn.RemoteAddr().String() + ` ` + conn.LocalAddr().String()
+		return true
+	})
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		data := make([]byte, conn.RdBuf.Len())
+		conn.Read(data)
+		events <- `read ` + string(data)
+		return true
+	})
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		events <- `close`
+	})
+
+	return srv, addr, events, startTestServer(t, srv)
+}
+
+func expectEvent(t *testing.T, events chan string, exp string) {
+	select {
+	case event := <-events:
+		if event != exp {
+			t.Fatalf(`expect event %q got %q`, exp, event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf(`no event %q`, exp)
+	}
+}
+
+func Test_TCPServer_ProxyProtocol_Strict(t *testing.T) {
+	srv, addr, events, stop := startProxyServer(t, ServerOptions{ProxyProtocol: ProxyProtocolStrict})
+	defer stop()
+
+	client, err := net.Dial(`tcp`, addr)
+	if err != nil {
+		t.Fatalf(`Dial failed: %s`, err)
+	}
+	defer client.Close()
+
+	// заголовок приходит частями, а данные - вместе с его концом
+	if _, err := client.Write([]byte(`PROXY TCP4 203.0.113.7 198.51.100.1 `)); err != nil {
+		t.Fatalf(`Write failed: %s`, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := client.Write([]byte("40000 443\r\nhello")); err != nil {
+		t.Fatalf(`Write failed: %s`, err)
+	}
+
+	expectEvent(t, events, `connect 203.0.113.7:40000 198.51.100.1:443`)
+	expectEvent(t, events, `read hello`)
+
+	// без заголовка соединение закрывается, а обработчики о нем не узнают
+	bad, err := net.Dial(`tcp`, addr)
+	if err != nil {
+		t.Fatalf(`Dial failed: %s`, err)
+	}
+	defer bad.Close()
+
+	if _, err := bad.Write([]byte("GET / HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatalf(`Write failed: %s`, err)
+	}
+
+	bad.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bad.Read(make([]byte, 1)); err == nil {
+		t.Fatalf(`Connection without header must be closed`)
+	} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Fatalf(`Connection without header was not closed`)
+	}
+
+	if got := srv.Rejected(); got != 1 {
+		t.Fatalf(`expect 1 rejected connection got %d`, got)
+	}
+
+	select {
+	case event := <-events:
+		t.Fatalf(`unexpected event %q`, event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_TCPServer_ProxyProtocol_Optional(t *testing.T) {
+	_, addr, events, stop := startProxyServer(t, ServerOptions{ProxyProtocol: ProxyProtocolOptional})
+	defer stop()
+
+	client, err := net.Dial(`tcp`, addr)
+	if err != nil {
+		t.Fatalf(`Dial failed: %s`, err)
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte(`hello`)); err != nil {
+		t.Fatalf(`Write failed: %s`, err)
+	}
+
+	expectEvent(t, events, `connect `+client.LocalAddr().String()+` `+client.RemoteAddr().String())
+	expectEvent(t, events, `read hello`)
+}
+
+func Test_TCPServer_ProxyProtocol_TLS(t *testing.T) {
+	cert := testCertificate(t, `proxy.test`)
+	_, addr, events, stop := startProxyServer(t, ServerOptions{
+		ProxyProtocol: ProxyProtocolStrict,
+		TLSConfig:     &tls.Config{Certificates: []tls.Certificate{cert}},
+	})
+	defer stop()
+
+	raw, err := net.Dial(`tcp`, addr)
+	if err != nil {
+		t.Fatalf(`Dial failed: %s`, err)
+	}
+	defer raw.Close()
+
+	addrs := []byte{203, 0, 113, 7, 198, 51, 100, 1, 0x9C, 0x40, 0x01, 0xBB}
+	if _, err := raw.Write(buildProxyV2(0x01, 0x11, addrs, nil, false)); err != nil {
+		t.Fatalf(`Write failed: %s`, err)
+	}
+
+	client := tls.Client(raw, &tls.Config{RootCAs: testRootCAs(cert), ServerName: `proxy.test`})
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write([]byte(`hello`)); err != nil {
+		t.Fatalf(`TLS Write failed: %s`, err)
+	}
+
+	expectEvent(t, events, `connect 203.0.113.7:40000 198.51.100.1:443`)
+	expectEvent(t, events, `read hello`)
+
+	// close_notify от клиента
+	client.Close()
+	expectEvent(t, events, `close`)
+}
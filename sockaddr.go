@@ -0,0 +1,100 @@
+package gonetz
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// netAddr преобразует адрес из буфера accept в net.Addr (*net.TCPAddr или *net.UnixAddr)
+func (buf *sockaddrBuf) netAddr() net.Addr {
+	switch buf.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&buf.RawSockaddrAny))
+		return &net.TCPAddr{
+			IP:   net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]),
+			Port: networkPort(&sa.Port),
+		}
+
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&buf.RawSockaddrAny))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return &net.TCPAddr{
+			IP:   ip,
+			Port: networkPort(&sa.Port),
+			Zone: ipv6ZoneName(sa.Scope_id),
+		}
+
+	case syscall.AF_UNIX:
+		sa := (*syscall.RawSockaddrUnix)(unsafe.Pointer(&buf.RawSockaddrAny))
+		// клиенты unix сокетов обычно не привязаны к адресу, и тогда путь пустой
+		pathLen := int(buf.Len) - int(unsafe.Offsetof(sa.Path))
+		if pathLen < 0 {
+			pathLen = 0
+		} else if pathLen > len(sa.Path) {
+			pathLen = len(sa.Path)
+		}
+
+		path := make([]byte, pathLen)
+		for i := range path {
+			path[i] = byte(sa.Path[i])
+		}
+		return &net.UnixAddr{Name: unixPathName(path), Net: `unix`}
+	}
+
+	return nil
+}
+
+// sockaddrToNetAddr преобразует адрес из syscall в net.Addr (*net.TCPAddr или *net.UnixAddr)
+func sockaddrToNetAddr(sa syscall.Sockaddr) net.Addr {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return &net.TCPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]), Port: sa.Port}
+
+	case *syscall.SockaddrInet6:
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return &net.TCPAddr{IP: ip, Port: sa.Port, Zone: ipv6ZoneName(sa.ZoneId)}
+
+	case *syscall.SockaddrUnix:
+		// syscall уже заменил ведущий 0 abstract namespace на @
+		return &net.UnixAddr{Name: sa.Name, Net: `unix`}
+	}
+
+	return nil
+}
+
+// networkPort читает порт в сетевом порядке байт
+func networkPort(port *uint16) int {
+	p := (*[2]byte)(unsafe.Pointer(port))
+	return int(p[0])<<8 | int(p[1])
+}
+
+// ipv6ZoneName - обратное к ipv6ZoneID преобразование
+func ipv6ZoneName(zoneID uint32) string {
+	if zoneID == 0 {
+		return ``
+	} else if iface, err := net.InterfaceByIndex(int(zoneID)); err == nil {
+		return iface.Name
+	}
+	return strconv.FormatUint(uint64(zoneID), 10)
+}
+
+// unixPathName преобразует путь из sockaddr_un в имя, как его показывает net (abstract namespace с префиксом @)
+func unixPathName(path []byte) string {
+	if len(path) == 0 {
+		return ``
+	} else if path[0] == 0 {
+		return `@` + string(path[1:])
+	}
+
+	for i, c := range path {
+		if c == 0 {
+			path = path[:i]
+			break
+		}
+	}
+	return string(path)
+}
@@ -0,0 +1,103 @@
+package gonetz
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testConnAddrs подключается к серверу и сравнивает адреса TCPConn с адресами клиента
+func testConnAddrs(t *testing.T, opts ServerOptions, network, address string) {
+	srv, err := NewServerWithOptions(opts)
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	type addrs struct {
+		remote, local net.Addr
+	}
+	connected := make(chan addrs, 1)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		connected <- addrs{remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	if network != `unix` {
+		address += `:` + strconv.Itoa(getSocketPort(srv.fd))
+	}
+
+	client, err := net.DialTimeout(network, address, 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+
+	var got addrs
+	select {
+	case got = <-connected:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientConnect was not called`)
+	}
+
+	expectedRemote := client.LocalAddr().String()
+	if network == `unix` {
+		// клиент не привязан к адресу, а net показывает такой адрес как @
+		expectedRemote = ``
+	}
+
+	if (got.remote == nil) || (got.remote.Network() != client.LocalAddr().Network()) {
+		t.Fatalf(`wrong RemoteAddr network: %v`, got.remote)
+	} else if got.remote.String() != expectedRemote {
+		t.Fatalf(`RemoteAddr mismatch: %q != %q`, got.remote, expectedRemote)
+	} else if (got.local == nil) || (got.local.String() != client.RemoteAddr().String()) {
+		t.Fatalf(`LocalAddr mismatch: %v != %s`, got.local, client.RemoteAddr())
+	}
+}
+
+func Test_TCPConn_Addr_IPv4(t *testing.T) {
+	testConnAddrs(t, ServerOptions{Host: `127.0.0.1`, Workers: 1}, `tcp`, `127.0.0.1`)
+}
+
+// на 0.0.0.0 локальный адрес соединения отличается от адреса слушающего сокета
+func Test_TCPConn_Addr_Any(t *testing.T) {
+	testConnAddrs(t, ServerOptions{Workers: 1}, `tcp`, `127.0.0.1`)
+}
+
+func Test_TCPConn_Addr_IPv6(t *testing.T) {
+	skipWithoutIPv6(t)
+	testConnAddrs(t, ServerOptions{Host: `::1`, Workers: 1}, `tcp`, `[::1]`)
+}
+
+func Test_TCPConn_Addr_Unix(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `gonetz`)
+	if err != nil {
+		t.Fatalf(`TempDir failed: %s`, err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, `srv.sock`)
+	testConnAddrs(t, ServerOptions{Network: `unix`, Host: path, Workers: 1}, `unix`, path)
+}
+
+func Test_sockaddrToNetAddr(t *testing.T) {
+	sa := &syscall.SockaddrInet6{Port: 80, ZoneId: 0}
+	copy(sa.Addr[:], net.ParseIP(`2001:db8::1`))
+	if addr := sockaddrToNetAddr(sa); addr.String() != `[2001:db8::1]:80` {
+		t.Fatalf(`wrong IPv6 address: %s`, addr)
+	}
+
+	if name := unixPathName([]byte("/tmp/sock\x00\x00")); name != `/tmp/sock` {
+		t.Fatalf(`wrong unix path: %q`, name)
+	} else if name := unixPathName([]byte("\x00abstract")); name != `@abstract` {
+		t.Fatalf(`wrong abstract unix path: %q`, name)
+	}
+}
@@ -0,0 +1,194 @@
+package gonetz
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+type (
+	// AccessRules - правила фильтрации входящих tcp соединений по адресу клиента (см. TCPServer.SetAccessRules)
+	AccessRules struct {
+		// Allow - если не пуст, то принимаются только соединения из этих подсетей (CIDR или отдельные адреса)
+		Allow []string
+		// Deny - подсети, соединения из которых закрываются сразу после accept. Приоритетнее Allow
+		Deny []string
+		// MaxPerIP - ограничение количества одновременных соединений с одного адреса (0 - без ограничения)
+		MaxPerIP int
+		// PrefixV4 и PrefixV6 - длина префикса, по которому адреса объединяются для MaxPerIP.
+		// По умолчанию 32 и 128 (каждый адрес отдельно)
+		PrefixV4 int
+		PrefixV6 int
+	}
+
+	// accessRules - разобранные AccessRules. После публикации в TCPServer.access не меняются
+	accessRules struct {
+		allow    []*net.IPNet
+		deny     []*net.IPNet
+		maxPerIP int
+		maskV4   net.IPMask
+		maskV6   net.IPMask
+	}
+
+	// peerKey - адрес клиента (IPv4 в виде IPv4-mapped IPv6), обрезанный до префикса из AccessRules
+	peerKey [net.IPv6len]byte
+
+	// peerCounter считает соединения по peerKey для AccessRules.MaxPerIP
+	peerCounter struct {
+		mu     sync.Mutex
+		counts map[peerKey]int
+	}
+)
+
+// SetAccessRules заменяет правила фильтрации входящих соединений. Можно вызывать в любой момент, в т.ч. во время
+// работы сервера: новые правила применяются к следующим accept, уже принятые соединения не закрываются.
+// Для unix сокетов правила не применяются
+func (srv *TCPServer) SetAccessRules(rules AccessRules) error {
+	parsed, err := parseAccessRules(rules)
+	if err != nil {
+		return err
+	}
+
+	srv.access.Store(parsed)
+	return nil
+}
+
+func parseAccessRules(rules AccessRules) (parsed *accessRules, err error) {
+	parsed = &accessRules{maxPerIP: rules.MaxPerIP}
+
+	if parsed.allow, err = parseSubnets(rules.Allow); err != nil {
+		return nil, err
+	} else if parsed.deny, err = parseSubnets(rules.Deny); err != nil {
+		return nil, err
+	}
+
+	prefixV4, prefixV6 := rules.PrefixV4, rules.PrefixV6
+	if (prefixV4 <= 0) || (prefixV4 > 8*net.IPv4len) {
+		prefixV4 = 8 * net.IPv4len
+	}
+	if (prefixV6 <= 0) || (prefixV6 > 8*net.IPv6len) {
+		prefixV6 = 8 * net.IPv6len
+	}
+	parsed.maskV4 = net.CIDRMask(prefixV4, 8*net.IPv4len)
+	parsed.maskV6 = net.CIDRMask(prefixV6, 8*net.IPv6len)
+
+	return parsed, nil
+}
+
+// parseSubnets разбирает список подсетей. Адрес без префикса означает подсеть из одного адреса
+func parseSubnets(list []string) (subnets []*net.IPNet, err error) {
+	for _, s := range list {
+		if strings.IndexByte(s, '/') == -1 {
+			if ip := net.ParseIP(s); ip == nil {
+			} else if ip.To4() != nil {
+				s += `/32`
+			} else {
+				s += `/128`
+			}
+		}
+
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+
+	return subnets, nil
+}
+
+func (rules *accessRules) allowed(ip net.IP) bool {
+	for _, subnet := range rules.deny {
+		if subnet.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(rules.allow) == 0 {
+		return true
+	}
+
+	for _, subnet := range rules.allow {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rules *accessRules) peerKey(ip net.IP) (key peerKey) {
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(key[:], ip4.Mask(rules.maskV4).To16())
+	} else {
+		copy(key[:], ip.Mask(rules.maskV6))
+	}
+	return key
+}
+
+// acquire учитывает соединение с адреса key, если их меньше limit
+func (pc *peerCounter) acquire(key peerKey, limit int) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.counts[key] >= limit {
+		return false
+	}
+
+	if pc.counts == nil {
+		pc.counts = make(map[peerKey]int)
+	}
+	pc.counts[key]++
+	return true
+}
+
+func (pc *peerCounter) release(key peerKey) {
+	pc.mu.Lock()
+	if pc.counts[key]--; pc.counts[key] <= 0 {
+		delete(pc.counts, key)
+	}
+	pc.mu.Unlock()
+}
+
+// admitPeer проверяет адрес клиента только что принятого соединения по AccessRules.
+// При успехе соединение учитывается в AccessRules.MaxPerIP (см. closeConn), иначе сокет закрывается
+func (srv *TCPServer) admitPeer(conn *TCPConn, addr *sockaddrBuf) bool {
+	rules, _ := srv.access.Load().(*accessRules)
+	if rules == nil {
+		return true
+	}
+
+	ip := addr.ip()
+	if ip == nil {
+		// unix сокет
+		return true
+	} else if !rules.allowed(ip) {
+		srv.rejectConn(conn.fd, nil)
+		return false
+	} else if rules.maxPerIP <= 0 {
+		return true
+	}
+
+	key := rules.peerKey(ip)
+	if !srv.peers.acquire(key, rules.maxPerIP) {
+		srv.rejectConn(conn.fd, srv.options.RejectMessage)
+		return false
+	}
+
+	conn.peerKey, conn.peerCounted = key, true
+	return true
+}
+
+// ip возвращает IP адрес из буфера (без копирования) или nil, если это не IPv4/IPv6 адрес
+func (buf *sockaddrBuf) ip() net.IP {
+	switch buf.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(&buf.RawSockaddrAny))
+		return sa.Addr[:]
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(&buf.RawSockaddrAny))
+		return sa.Addr[:]
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package gonetz
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_parseAccessRules(t *testing.T) {
+	if _, err := parseAccessRules(AccessRules{Deny: []string{`10.0.0.0/33`}}); err == nil {
+		t.Fatalf(`wrong CIDR was parsed`)
+	} else if _, err := parseAccessRules(AccessRules{Allow: []string{`bad`}}); err == nil {
+		t.Fatalf(`wrong address was parsed`)
+	}
+
+	rules, err := parseAccessRules(AccessRules{
+		Allow:    []string{`10.0.0.0/8`, `2001:db8::/32`, `192.168.1.1`},
+		Deny:     []string{`10.1.0.0/16`},
+		PrefixV4: 24,
+		PrefixV6: 64,
+	})
+	if err != nil {
+		t.Fatalf(`parseAccessRules failed: %s`, err)
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{`10.2.3.4`, true},
+		{`::ffff:10.2.3.4`, true},
+		{`10.1.2.3`, false},
+		{`192.168.1.1`, true},
+		{`192.168.1.2`, false},
+		{`2001:db8::1`, true},
+		{`2001:db9::1`, false},
+	}
+	for _, test := range tests {
+		if allowed := rules.allowed(net.ParseIP(test.ip)); allowed != test.allowed {
+			t.Errorf(`allowed(%s) = %v, expected %v`, test.ip, allowed, test.allowed)
+		}
+	}
+
+	keyOf := func(ip string) peerKey {
+		return rules.peerKey(net.ParseIP(ip))
+	}
+	if keyOf(`10.2.3.4`) != keyOf(`10.2.3.200`) {
+		t.Errorf(`IPv4 addresses from one /24 must share the key`)
+	} else if keyOf(`10.2.3.4`) == keyOf(`10.2.4.4`) {
+		t.Errorf(`IPv4 addresses from different /24 must have different keys`)
+	} else if keyOf(`10.2.3.4`) != rules.peerKey(net.IPv4(10, 2, 3, 4).To4()) {
+		t.Errorf(`IPv4 key must not depend on address length`)
+	} else if keyOf(`2001:db8::1`) != keyOf(`2001:db8::2:1`) {
+		t.Errorf(`IPv6 addresses from one /64 must share the key`)
+	} else if keyOf(`2001:db8::1`) == keyOf(`2001:db8:0:1::1`) {
+		t.Errorf(`IPv6 addresses from different /64 must have different keys`)
+	}
+}
+
+func Test_TCPServer_AccessRules(t *testing.T) {
+	srv, addr := newTestServer(t, ServerOptions{Workers: 1})
+
+	if err := srv.SetAccessRules(AccessRules{Deny: []string{`127.0.0.0/8`}}); err != nil {
+		t.Fatalf(`SetAccessRules failed: %s`, err)
+	}
+
+	connected := make(chan bool, 1)
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		connected <- true
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	dial := func() net.Conn {
+		client, err := net.DialTimeout(`tcp`, addr, 1*time.Second)
+		if err != nil {
+			t.Fatalf(`Could not dial to server: %s`, err)
+		}
+		return client
+	}
+
+	client := dial()
+	defer client.Close()
+
+	_ = client.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if data, err := ioutil.ReadAll(client); err != nil {
+		t.Fatalf(`denied connection was not closed: %s`, err)
+	} else if len(data) != 0 {
+		t.Fatalf(`denied connection received data: %q`, data)
+	} else if rejected := srv.Rejected(); rejected != 1 {
+		t.Fatalf(`wrong rejected counter: %d`, rejected)
+	}
+
+	select {
+	case <-connected:
+		t.Fatalf(`OnClientConnect was called for denied connection`)
+	default:
+	}
+
+	// правила меняются без перезапуска сервера
+	if err := srv.SetAccessRules(AccessRules{Allow: []string{`127.0.0.1`}}); err != nil {
+		t.Fatalf(`SetAccessRules failed: %s`, err)
+	}
+
+	client = dial()
+	defer client.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`allowed connection was not accepted`)
+	}
+}
+
+func Test_TCPServer_MaxPerIP(t *testing.T) {
+	srv, addr := newTestServer(t, ServerOptions{
+		Workers:       1,
+		RejectMessage: []byte("busy\n"),
+	})
+
+	if err := srv.SetAccessRules(AccessRules{MaxPerIP: 1, PrefixV4: 8}); err != nil {
+		t.Fatalf(`SetAccessRules failed: %s`, err)
+	}
+
+	connected := make(chan bool, 2)
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		connected <- true
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	dial := func() net.Conn {
+		client, err := net.DialTimeout(`tcp`, addr, 1*time.Second)
+		if err != nil {
+			t.Fatalf(`Could not dial to server: %s`, err)
+		}
+		return client
+	}
+
+	client1 := dial()
+	defer client1.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`first connection was not accepted`)
+	}
+
+	client2 := dial()
+	defer client2.Close()
+
+	_ = client2.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if data, err := ioutil.ReadAll(client2); err != nil {
+		t.Fatalf(`Could not read from rejected connection: %s`, err)
+	} else if string(data) != "busy\n" {
+		t.Fatalf(`unexpected reject message: %q`, data)
+	}
+
+	// после закрытия первого соединения место освобождается
+	_ = client1.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	client3 := dial()
+	defer client3.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`connection was not accepted after the previous one was closed`)
+	}
+}
@@ -2,26 +2,477 @@ package gonetz
 
 import (
 	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
 )
 
 type (
-	// TCPConn реализует двунаправленый буфер полученных и готовых к отправке данных на соединении
+	closeMode int32
+
+	// TCPConn реализует двунаправленый буфер полученных и готовых к отправке данных на соединении.
+	// RdBuf, WrBuf, Read и Write можно использовать только из обработчиков соединения (горутина воркера).
+	// Close и CloseAfterFlush можно вызывать из любой горутины
 	TCPConn struct {
-		fd    int
+		// Context - произвольные данные обработчиков (например, состояние парсера протокола).
+		// Обнуляется после вызова OnClientClose
+		Context interface{}
+
+		id     uint64
+		fd     int
+		worker *tcpWorker
+		events uint32 // маска событий, с которой fd сейчас зарегистрирован в epoll (0 - еще не зарегистрирован)
+		closed bool   // fd закрыт (и мог уже достаться новому соединению). Меняется только в горутине воркера
+
+		unix     bool           // соединение через unix сокет
+		accepted bool           // входящее соединение, учитывается в ServerOptions.MaxConnections
+		peerCred *syscall.Ucred // SO_PEERCRED для unix сокетов
+		dial     *dialState     // исходящее соединение, которое еще устанавливается (см. TCPServer.Dial)
+
+		remoteAddr net.Addr
+		localAddr  net.Addr // nil - еще не известен (сервер слушает на 0.0.0.0 или ::), см. LocalAddr
+
+		peerKey     peerKey // адрес клиента для AccessRules.MaxPerIP
+		peerCounted bool    // соединение учтено в TCPServer.peers
+
+		tls *tlsLayer // TLS поверх соединения (см. ServerOptions.TLSConfig)
+
+		// OnClientConnect еще не вызван: ждем заголовок PROXY protocol или завершения TLS handshake
+		preConnect   bool
+		proxyPending bool // RdBuf должен начинаться с заголовка PROXY protocol
+		proxyHeader  *ProxyHeader
+
+		// обработчики, заменяющие обработчики сервера для этого соединения (используется в Pool)
+		rdEvent ConnEvent
+		wrEvent ConnEvent
+		wlEvent ConnEvent
+		efEvent ConnEvent
+		clEvent CloseEvent
+
+		readPending bool  // бюджет чтения исчерпан, а в сокете еще могут оставаться данные
+		closeState  int32 // closeMode | (CloseReason << 8), меняется атомарно
+
+		// приостановка чтения из сокета. Меняется только в горутине воркера (или до регистрации соединения)
+		readPaused    bool // через PauseRead
+		readThrottled bool // RdBuf достиг readHighWater и еще не опустился до readLowWater
+		readEOF       bool // клиент закрыл свою сторону соединения, читать больше нечего (см. OnClientEOF)
+		readHighWater int
+		readLowWater  int
+
+		// ограничение WrBuf. Меняется только в горутине воркера (или до регистрации соединения)
+		writeLimit    int
+		writeLowWater int
+		writeAboveLow bool // WrBuf превысил writeLowWater (или Write получил отказ), ждем OnClientWriteLowWater
+
+		// таймауты (0 - без ограничения) и время последней активности. Меняются только в горутине воркера
+		idleTimeout  time.Duration
+		readTimeout  time.Duration
+		writeTimeout time.Duration
+		lastRead     time.Time // последнее чтение данных
+		lastWrite    time.Time // последняя запись в сокет (или начало ожидания записи)
+		timerAt      time.Time // срок актуальной записи в колесе таймеров воркера (zero - записи нет)
+		timerGen     uint32    // поколение актуальной записи в колесе таймеров
+
 		RdBuf BufChain
 		WrBuf BufChain
 	}
 )
 
+const (
+	closeModeNone  closeMode = iota
+	closeModeFlush           // закрыть после отправки всего WrBuf
+	closeModeAbort           // закрыть немедленно, отбросив WrBuf
+)
+
 // Read реализует io.Reader
 func (conn *TCPConn) Read(b []byte) (n int, err error) {
 	n, err = conn.RdBuf.Read(b)
 	if n == 0 {
 		err = io.EOF
+	} else if conn.readThrottled {
+		conn.updateReadThrottle()
 	}
 	return
 }
 
-//func (conn *TCPConn) Write(b []byte) (n int, err error) {
-//	return conn.RdBuf.Write(b)
-//}
+// Write реализует io.Writer.
+// Данные дописываются в WrBuf (для TLS соединений - в зашифрованном виде) и сразу же делается попытка их отправить.
+// Все, что не удалось отправить сразу, досылается воркером по готовности сокета к записи (EPOLLOUT).
+// Если с b размер WrBuf превысил бы ограничение (см. SetWriteBufferLimit), то ничего не записывается
+// и возвращается ErrBufferFull. После закрытия соединения возвращается ErrConnClosed
+func (conn *TCPConn) Write(b []byte) (n int, err error) {
+	if conn.closed {
+		return 0, ErrConnClosed
+	} else if !conn.writeAllowed(len(b)) {
+		return 0, ErrBufferFull
+	}
+
+	if conn.tls != nil {
+		return conn.tls.write(b)
+	}
+	return conn.writeRaw(b)
+}
+
+// writeParts записывает parts подряд как один Write, но без склейки в промежуточный буфер (кроме TLS соединений)
+func (conn *TCPConn) writeParts(parts ...[]byte) error {
+	size := 0
+	for _, b := range parts {
+		size += len(b)
+	}
+
+	if conn.closed {
+		return ErrConnClosed
+	} else if !conn.writeAllowed(size) {
+		return ErrBufferFull
+	}
+
+	var err error
+	if conn.tls != nil {
+		// одна запись TLS вместо нескольких мелких
+		buf := make([]byte, 0, size)
+		for _, b := range parts {
+			buf = append(buf, b...)
+		}
+		_, err = conn.tls.write(buf)
+	} else {
+		_, err = conn.writeRaw(parts...)
+	}
+	return err
+}
+
+// writeAllowed проверяет, что запись size байт не превысит ограничение WrBuf (см. SetWriteBufferLimit)
+func (conn *TCPConn) writeAllowed(size int) bool {
+	if (conn.writeLimit > 0) && (conn.WrBuf.Len()+size > conn.writeLimit) {
+		// если WrBuf ниже порога, то запись больше, чем вообще можно записать, и ждать OnClientWriteLowWater бессмысленно.
+		// Сбрасывать флаг здесь нельзя: уведомление о прошлом превышении порога могло быть еще не отправлено
+		if conn.WrBuf.Len() > conn.writeLowWater {
+			conn.writeAboveLow = true
+		}
+		return false
+	}
+	return true
+}
+
+// writeRaw дописывает parts в WrBuf в неизменном виде и пытается их отправить
+func (conn *TCPConn) writeRaw(parts ...[]byte) (n int, err error) {
+	if (conn.WrBuf.Len() == 0) && (conn.events != 0) {
+		// таймаут записи отсчитывается от момента, когда в WrBuf появились данные
+		conn.lastWrite = conn.worker.now
+	}
+
+	for _, b := range parts {
+		written, _ := conn.WrBuf.Write(b)
+		n += written
+	}
+
+	if err = conn.flush(); err != nil {
+		return 0, err
+	}
+
+	if (conn.writeLimit > 0) && (conn.WrBuf.Len() > conn.writeLowWater) {
+		conn.writeAboveLow = true
+	} else if conn.writeAboveLow && (conn.worker != nil) {
+		// флаг сбрасывается только вместе с вызовом OnClientWriteLowWater. WrBuf мог опустеть прямо здесь,
+		// и тогда EPOLLOUT, по которому воркер обычно вызывает обработчик, уже не придет
+		w := conn.worker
+		w.postFunc(func() {
+			if w.clients[conn.fd] == conn { // соединение еще не закрыто
+				w.notifyWriteLowWater(conn)
+				w.closeIfRequested(conn)
+			}
+		})
+	}
+
+	return n, nil
+}
+
+// Post выполняет fn в горутине воркера соединения, т.е. там же, где вызываются обработчики.
+// Так из других горутин можно работать с RdBuf, WrBuf, Read и Write. Соединение к этому моменту может оказаться
+// уже закрытым (fn выполняется и после OnClientClose): Write тогда вернет ErrConnClosed.
+// Может вызываться из любой горутины
+func (conn *TCPConn) Post(fn func()) {
+	conn.worker.postFunc(fn)
+}
+
+// ID возвращает уникальный в пределах сервера номер соединения. Номера растут монотонно и, в отличие от fd,
+// не переиспользуются после закрытия
+func (conn *TCPConn) ID() uint64 {
+	return conn.id
+}
+
+// RemoteAddr возвращает адрес другой стороны соединения (*net.TCPAddr или *net.UnixAddr)
+func (conn *TCPConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+// LocalAddr возвращает локальный адрес соединения (*net.TCPAddr или *net.UnixAddr).
+// Если сервер слушает на всех адресах, то при первом вызове делается getsockname, так что вызывать LocalAddr
+// можно только из обработчиков соединения
+func (conn *TCPConn) LocalAddr() net.Addr {
+	if (conn.localAddr == nil) && !conn.closed {
+		if sa, err := syscall.Getsockname(conn.fd); err == nil {
+			conn.localAddr = sockaddrToNetAddr(sa)
+		}
+	}
+	return conn.localAddr
+}
+
+// Close запрашивает немедленное закрытие соединения с отбрасыванием неотправленных данных из WrBuf.
+// Соединение закрывается с SO_LINGER 0, т.е. клиент получит RST.
+// Само закрытие выполняется воркером соединения после возврата из текущего обработчика
+func (conn *TCPConn) Close() error {
+	if conn.requestClose(closeModeAbort, CloseReasonHandler) {
+		conn.worker.post(conn)
+	}
+	return nil
+}
+
+// CloseAfterFlush запрашивает закрытие соединения после отправки всех данных из WrBuf.
+// Все новые данные от клиента после этого вызова отбрасываются
+func (conn *TCPConn) CloseAfterFlush() {
+	if conn.requestClose(closeModeFlush, CloseReasonHandler) {
+		conn.worker.post(conn)
+	}
+}
+
+// requestClose атомарно повышает режим закрытия соединения до mode.
+// Возвращает false, если уже был запрошен такой же или более жесткий режим
+func (conn *TCPConn) requestClose(mode closeMode, reason CloseReason) bool {
+	newState := int32(mode) | (int32(reason) << 8)
+
+	for {
+		oldState := atomic.LoadInt32(&conn.closeState)
+		if closeMode(oldState&0xFF) >= mode {
+			return false
+		} else if atomic.CompareAndSwapInt32(&conn.closeState, oldState, newState) {
+			return true
+		}
+	}
+}
+
+// closeRequest возвращает запрошенный режим закрытия соединения и его причину
+func (conn *TCPConn) closeRequest() (closeMode, CloseReason) {
+	state := atomic.LoadInt32(&conn.closeState)
+	return closeMode(state & 0xFF), CloseReason(state >> 8)
+}
+
+// closeFd закрывает сокет соединения. Номер fd после этого может сразу достаться новому соединению,
+// так что соединение помечается закрытым, и Write, flush и updateEvents больше не обращаются к сокету.
+// Сам conn.fd не меняется: по нему другие горутины ищут соединение в воркере (см. post)
+func (conn *TCPConn) closeFd() {
+	_, _, _ = syscall.Syscall(syscall.SYS_CLOSE, uintptr(conn.fd), 0, 0)
+
+	conn.closed = true
+	conn.events = 0
+}
+
+// flush отправляет в сокет максимум данных из WrBuf без блокировки.
+// Если отправить все сразу не удалось, то соединение подписывается на EPOLLOUT
+func (conn *TCPConn) flush() error {
+	if conn.closed {
+		return ErrConnClosed
+	} else if conn.events == 0 {
+		// соединение еще не зарегистрировано в воркере (например, запись из OnClientConnect),
+		// так что данные будут отправлены по первому EPOLLOUT
+		return nil
+	}
+
+	for conn.WrBuf.Len() > 0 {
+		chunk := conn.WrBuf.head()
+
+		r1, _, errno := syscallWrappers.Syscall(
+			syscall.SYS_WRITE,
+			uintptr(conn.fd),
+			uintptr(unsafe.Pointer(&chunk[0])),
+			uintptr(len(chunk)),
+		)
+
+		if errno == syscall.EINTR {
+			continue
+		} else if errno == syscall.EAGAIN {
+			// буфер сокета заполнен, остаток допишется по EPOLLOUT
+			break
+		} else if errno != 0 {
+			return errno
+		}
+
+		conn.WrBuf.Discard(int(r1))
+		conn.lastWrite = conn.worker.now
+	}
+
+	if conn.WrBuf.Len() > 0 {
+		// начался (или продолжается) отсчет таймаута записи
+		conn.worker.updateTimer(conn)
+	}
+
+	return conn.updateEvents()
+}
+
+// PauseRead приостанавливает чтение из сокета до вызова ResumeRead: новые данные копятся в буфере ядра,
+// а клиент упирается в TCP окно. Вызывается из обработчиков соединения
+func (conn *TCPConn) PauseRead() {
+	conn.readPaused = true
+	conn.updateEventsIfRegistered()
+}
+
+// ResumeRead возобновляет чтение, приостановленное через PauseRead.
+// Приостановка по порогам RdBuf (см. SetReadWatermarks) при этом перепроверяется
+func (conn *TCPConn) ResumeRead() {
+	conn.readPaused = false
+	conn.updateReadThrottle()
+	conn.updateEventsIfRegistered()
+}
+
+// SetReadWatermarks задает пороги RdBuf: при достижении high чтение из сокета приостанавливается
+// и возобновляется, когда обработчики вычитают RdBuf до low. high <= 0 снимает ограничение,
+// а low вне (0, high) заменяется на high/2. Вызывается из обработчиков соединения.
+// Порог проверяется после вызова обработчиков и в Read, так что при вычитывании RdBuf
+// в обход Read вне обработчиков нужно вызвать ResumeRead
+func (conn *TCPConn) SetReadWatermarks(high, low int) {
+	if (low <= 0) || (low >= high) {
+		low = high / 2
+	}
+	conn.readHighWater, conn.readLowWater = high, low
+	conn.updateReadThrottle()
+}
+
+// SetWriteBufferLimit ограничивает размер WrBuf: Write, который превысил бы limit, возвращает ErrBufferFull.
+// Когда WrBuf после превышения lowWater опускается до него, вызывается обработчик OnClientWriteLowWater.
+// limit <= 0 снимает ограничение, а lowWater вне [0, limit) заменяется на limit/2.
+// Вызывается из обработчиков соединения
+func (conn *TCPConn) SetWriteBufferLimit(limit, lowWater int) {
+	if (lowWater < 0) || (lowWater >= limit) {
+		lowWater = limit / 2
+	}
+	conn.writeLimit, conn.writeLowWater = limit, lowWater
+	if limit <= 0 {
+		conn.writeAboveLow = false
+	}
+}
+
+// readAllowed сообщает, можно ли сейчас читать из сокета
+func (conn *TCPConn) readAllowed() bool {
+	return !conn.readPaused && !conn.readThrottled && !conn.readEOF
+}
+
+// readBufFull сообщает, что RdBuf достиг верхнего порога
+func (conn *TCPConn) readBufFull() bool {
+	return (conn.readHighWater > 0) && (conn.RdBuf.Len() >= conn.readHighWater)
+}
+
+// updateReadThrottle включает или снимает приостановку чтения по порогам RdBuf
+func (conn *TCPConn) updateReadThrottle() {
+	throttled := conn.readThrottled
+	if conn.readHighWater <= 0 {
+		throttled = false
+	} else if !throttled {
+		throttled = conn.readBufFull()
+	} else {
+		throttled = conn.RdBuf.Len() > conn.readLowWater
+	}
+
+	if throttled != conn.readThrottled {
+		conn.readThrottled = throttled
+		conn.updateEventsIfRegistered()
+	}
+}
+
+// updateEventsIfRegistered вызывает updateEvents для уже зарегистрированного в воркере соединения.
+// Незарегистрированное соединение получит актуальную маску при регистрации
+func (conn *TCPConn) updateEventsIfRegistered() {
+	if conn.events != 0 {
+		// при ошибке сокет уже сломан, и воркер закроет соединение по EPOLLERR/EPOLLHUP
+		_ = conn.updateEvents()
+	}
+}
+
+// SetIdleTimeout задает время без чтения и записи, после которого соединение закрывается с CloseReasonTimeout.
+// 0 - без ограничения. По умолчанию ServerOptions.IdleTimeout
+func (conn *TCPConn) SetIdleTimeout(timeout time.Duration) {
+	conn.idleTimeout = timeout
+	conn.timeoutsChanged()
+}
+
+// SetReadTimeout задает максимальное время ожидания новых данных от клиента.
+// 0 - без ограничения. По умолчанию ServerOptions.ReadTimeout
+func (conn *TCPConn) SetReadTimeout(timeout time.Duration) {
+	conn.readTimeout = timeout
+	conn.timeoutsChanged()
+}
+
+// SetWriteTimeout задает максимальное время, в течение которого данные из WrBuf могут не уходить в сокет.
+// 0 - без ограничения. По умолчанию ServerOptions.WriteTimeout
+func (conn *TCPConn) SetWriteTimeout(timeout time.Duration) {
+	conn.writeTimeout = timeout
+	conn.timeoutsChanged()
+}
+
+func (conn *TCPConn) timeoutsChanged() {
+	if conn.events != 0 {
+		conn.worker.updateTimer(conn)
+	} // иначе соединение еще не зарегистрировано, и таймер будет заведен при регистрации
+}
+
+// deadline возвращает ближайший срок истечения таймаутов соединения (zero - таймаутов нет)
+func (conn *TCPConn) deadline() (at time.Time) {
+	earlier := func(t time.Time) {
+		if at.IsZero() || t.Before(at) {
+			at = t
+		}
+	}
+
+	if conn.idleTimeout > 0 {
+		last := conn.lastRead
+		if conn.lastWrite.After(last) {
+			last = conn.lastWrite
+		}
+		earlier(last.Add(conn.idleTimeout))
+	}
+
+	if (conn.readTimeout > 0) && !conn.readEOF {
+		earlier(conn.lastRead.Add(conn.readTimeout))
+	}
+
+	if (conn.writeTimeout > 0) && (conn.WrBuf.Len() > 0) {
+		earlier(conn.lastWrite.Add(conn.writeTimeout))
+	}
+
+	if (conn.tls != nil) && !conn.tls.established && !conn.tls.deadline.IsZero() {
+		earlier(conn.tls.deadline)
+	}
+
+	return at
+}
+
+// updateEvents приводит маску событий соединения в epoll в соответствие с его текущим состоянием
+func (conn *TCPConn) updateEvents() error {
+	if conn.closed {
+		return ErrConnClosed
+	}
+
+	events := conn.wantedEvents()
+	if events == conn.events {
+		return nil
+	}
+
+	if err := conn.worker.epoll.ModifyClient(conn.fd, events); err != nil {
+		return err
+	}
+	conn.events = events
+
+	return nil
+}
+
+// wantedEvents возвращает маску событий, которая нужна соединению в его текущем состоянии
+func (conn *TCPConn) wantedEvents() uint32 {
+	events := uint32(EPOLLET)
+	if conn.readAllowed() {
+		events |= syscall.EPOLLIN
+	}
+	if (conn.WrBuf.Len() > 0) || (conn.dial != nil) { // завершение connect тоже приходит как EPOLLOUT
+		events |= syscall.EPOLLOUT
+	}
+	return events
+}
@@ -0,0 +1,195 @@
+package gonetz
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type (
+	// DialEvent - обработчик завершения TCPServer.Dial. Вызывается из горутины воркера.
+	// При err != nil соединение уже закрыто и использовать его нельзя
+	DialEvent func(conn *TCPConn, err error)
+
+	// dialState - состояние устанавливающегося исходящего соединения
+	dialState struct {
+		event DialEvent
+		timer *time.Timer
+		state int32 // dialStateConnecting, dialStateConnected или dialStateTimeout. Меняется атомарно
+		err   error // ошибка connect (SO_ERROR), пишется только воркером
+	}
+)
+
+const (
+	dialStateConnecting int32 = iota
+	dialStateConnected
+	dialStateTimeout
+)
+
+var (
+	// ErrDialTimeout - соединение не установилось за отведенное время
+	ErrDialTimeout = fmt.Errorf(`dial timeout`)
+	// ErrDialAborted - установка соединения прервана (например, остановкой сервера)
+	ErrDialAborted = fmt.Errorf(`dial aborted`)
+)
+
+// Dial асинхронно устанавливает исходящее TCP соединение с address (host:port) в одном из воркеров сервера.
+// Адрес резолвится синхронно, а connect выполняется без блокировки: его завершение воркер получает по EPOLLOUT.
+// По завершении из горутины воркера вызывается event. Если соединение установлено, дальше оно обслуживается
+// так же, как и принятые сервером: OnClientRead, OnClientWrite и OnClientClose (OnClientConnect не вызывается).
+// timeout ограничивает время установки соединения (0 - без ограничения).
+// После Close или Shutdown сервера возвращает ErrServerClosed, и event не вызывается.
+// Может вызываться из любой горутины, в том числе из обработчиков соединений
+func (srv *TCPServer) Dial(address string, timeout time.Duration, event DialEvent) error {
+	if srv.isClosed() || srv.isShuttingDown() {
+		return ErrServerClosed
+	}
+
+	addr, err := net.ResolveTCPAddr(`tcp`, address)
+	if err != nil {
+		return err
+	}
+
+	family, sa, err := tcpSockaddr(addr)
+	if err != nil {
+		return err
+	}
+
+	fd, err := syscallWrappers.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+
+	if err = syscall.Connect(fd, sa); (err != nil) && (err != syscall.EINPROGRESS) {
+		_ = syscall.Close(fd)
+		return err
+	}
+
+	conn := srv.newConn(fd, srv.getWorker())
+	conn.dial = &dialState{event: event}
+	conn.remoteAddr = addr
+
+	if timeout > 0 {
+		dial := conn.dial
+		dial.timer = time.AfterFunc(timeout, func() {
+			if atomic.CompareAndSwapInt32(&dial.state, dialStateConnecting, dialStateTimeout) {
+				conn.requestClose(closeModeAbort, CloseReasonError)
+				conn.worker.post(conn)
+			}
+		})
+	}
+
+	if !conn.worker.register(conn) {
+		// сервер остановился уже после проверки выше
+		if conn.dial.timer != nil {
+			conn.dial.timer.Stop()
+		}
+		_ = syscall.Close(fd)
+		return ErrServerClosed
+	}
+
+	return nil
+}
+
+// tcpSockaddr преобразует адрес из net в syscall.Sockaddr
+func tcpSockaddr(addr *net.TCPAddr) (family int, sa syscall.Sockaddr, err error) {
+	if ip := addr.IP.To4(); ip != nil {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa4.Addr[:], ip)
+		return syscall.AF_INET, sa4, nil
+	}
+
+	ip := addr.IP.To16()
+	if ip == nil {
+		return 0, nil, ErrWrongHost
+	}
+
+	sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+	copy(sa6.Addr[:], ip)
+
+	if addr.Zone == `` {
+	} else if zoneID, ok := ipv6ZoneID(addr.Zone); !ok {
+		return 0, nil, ErrWrongHost
+	} else {
+		sa6.ZoneId = zoneID
+	}
+
+	return syscall.AF_INET6, sa6, nil
+}
+
+// finishDial обрабатывает событие epoll для устанавливающегося исходящего соединения.
+// Возвращает true, если соединение установлено и событие нужно обработать как обычно
+func (w *tcpWorker) finishDial(conn *TCPConn, eventsMask uint32) bool {
+	dial := conn.dial
+
+	if soErr, err := syscall.GetsockoptInt(conn.fd, syscall.SOL_SOCKET, syscall.SO_ERROR); err != nil {
+		dial.err = err
+	} else if soErr != 0 {
+		dial.err = syscall.Errno(soErr)
+	} else if (eventsMask & syscall.EPOLLOUT) != 0 {
+	} else if (eventsMask & (syscall.EPOLLERR | syscall.EPOLLHUP)) != 0 {
+		dial.err = ErrDialAborted
+	} else {
+		// connect еще не завершен
+		return false
+	}
+
+	if dial.err != nil {
+		w.closeClient(conn, CloseReasonError)
+		return false
+	}
+
+	if !atomic.CompareAndSwapInt32(&dial.state, dialStateConnecting, dialStateConnected) {
+		// таймаут уже сработал, закрытие придет через post
+		return false
+	}
+
+	if dial.timer != nil {
+		dial.timer.Stop()
+	}
+	conn.dial = nil
+	conn.lastRead, conn.lastWrite = w.now, w.now
+
+	if dial.event != nil {
+		dial.event(conn, nil)
+	}
+
+	if w.closeIfRequested(conn) {
+		return false
+	}
+
+	// EPOLLOUT для connect больше не нужен (если обработчик ничего не записал)
+	if err := conn.updateEvents(); err != nil {
+		w.closeClient(conn, CloseReasonError)
+		return false
+	}
+	w.updateTimer(conn)
+
+	return true
+}
+
+// failDial закрывает так и не установившееся исходящее соединение и сообщает об ошибке в DialEvent
+func (srv *TCPServer) failDial(conn *TCPConn) {
+	dial := conn.dial
+
+	if dial.timer != nil {
+		dial.timer.Stop()
+	}
+
+	err := dial.err
+	if err != nil {
+	} else if atomic.LoadInt32(&dial.state) == dialStateTimeout {
+		err = ErrDialTimeout
+	} else {
+		err = ErrDialAborted
+	}
+
+	conn.WrBuf.Clean()
+	conn.closeFd()
+
+	if dial.event != nil {
+		dial.event(conn, err)
+	}
+}
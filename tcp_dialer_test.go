@@ -0,0 +1,207 @@
+package gonetz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func dialTestResult(t *testing.T, results chan error) error {
+	select {
+	case err := <-results:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatalf(`DialEvent was not called`)
+		return nil
+	}
+}
+
+// Тест на исходящее соединение к обычному (net) echo серверу
+func Test_TCPServer_Dial_1(t *testing.T) {
+	ln, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf(`Could not listen: %s`, err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	}()
+
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 2})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+	defer stopTestServer(srv)
+
+	var (
+		req     = []byte(`hello from gonetz`)
+		resp    = make(chan []byte, 1)
+		reasons = make(chan CloseReason, 1)
+		results = make(chan error, 1)
+		readed  []byte
+	)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		t.Errorf(`OnClientConnect was called for outgoing connection`)
+		return true
+	})
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		buf := make([]byte, conn.RdBuf.Len())
+		n, _ := conn.Read(buf)
+		readed = append(readed, buf[:n]...)
+		if len(readed) >= len(req) {
+			resp <- readed
+			return false
+		}
+		return true
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		reasons <- reason
+	})
+
+	err = srv.Dial(ln.Addr().String(), 1*time.Second, func(conn *TCPConn, err error) {
+		if err != nil {
+		} else if addr := conn.RemoteAddr(); addr.String() != ln.Addr().String() {
+			err = fmt.Errorf(`wrong RemoteAddr: %v`, addr)
+		} else if conn.LocalAddr() == nil {
+			err = fmt.Errorf(`LocalAddr is nil`)
+		} else {
+			_, err = conn.Write(req)
+		}
+		results <- err
+	})
+	if err != nil {
+		t.Fatalf(`Dial failed: %s`, err)
+	}
+
+	if err := dialTestResult(t, results); err != nil {
+		t.Fatalf(`Dial completed with error: %s`, err)
+	}
+
+	select {
+	case got := <-resp:
+		if !bytes.Equal(got, req) {
+			t.Fatalf(`Response differs from request: %q`, got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf(`No response from echo server`)
+	}
+
+	select {
+	case reason := <-reasons:
+		if reason != CloseReasonHandler {
+			t.Fatalf(`close reason mismatch: expect %s got %s`, CloseReasonHandler, reason)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientClose was not called`)
+	}
+}
+
+// Тест на ошибки установки соединения
+func Test_TCPServer_Dial_2(t *testing.T) {
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+	defer stopTestServer(srv)
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		t.Errorf(`OnClientClose was called for failed dial`)
+	})
+
+	if err := srv.Dial(`lol.kek`, 0, nil); err == nil {
+		t.Fatalf(`Dial to wrong address succeeded`)
+	}
+
+	// порт, на котором заведомо никто не слушает
+	ln, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf(`Could not listen: %s`, err)
+	}
+	address := ln.Addr().String()
+	_ = ln.Close()
+
+	results := make(chan error, 1)
+	if err := srv.Dial(address, 1*time.Second, func(conn *TCPConn, err error) { results <- err }); err != nil {
+		t.Fatalf(`Dial failed: %s`, err)
+	}
+
+	if err := dialTestResult(t, results); err != syscall.ECONNREFUSED {
+		t.Fatalf(`Dial to closed port returned wrong error: %v`, err)
+	}
+}
+
+// Тест на таймаут установки соединения: очередь listen заполнена, так что SYN остаются без ответа
+func Test_TCPServer_Dial_3(t *testing.T) {
+	lnFd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf(`cannot create test socket: %s`, err)
+	}
+	defer syscall.Close(lnFd)
+
+	if err := syscall.Bind(lnFd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatalf(`Bind failed: %s`, err)
+	} else if err := syscall.Listen(lnFd, 0); err != nil {
+		t.Fatalf(`Listen failed: %s`, err)
+	}
+
+	address := `127.0.0.1:` + strconv.Itoa(getSocketPort(lnFd))
+
+	// забиваю очередь listen
+	for i := 0; i < 4; i++ {
+		if conn, err := net.DialTimeout(`tcp`, address, 50*time.Millisecond); err == nil {
+			defer conn.Close()
+		}
+	}
+
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+	defer stopTestServer(srv)
+
+	results := make(chan error, 1)
+	if err := srv.Dial(address, 100*time.Millisecond, func(conn *TCPConn, err error) { results <- err }); err != nil {
+		t.Fatalf(`Dial failed: %s`, err)
+	}
+
+	if err := dialTestResult(t, results); err != ErrDialTimeout {
+		t.Fatalf(`Dial returned wrong error: %v`, err)
+	}
+}
+
+// Тест на Dial после остановки сервера: ошибка возвращается сразу, а DialEvent не вызывается
+func Test_TCPServer_Dial_4(t *testing.T) {
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	stopTestServer(srv)
+
+	ln, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatalf(`Could not listen: %s`, err)
+	}
+	defer ln.Close()
+
+	err = srv.Dial(ln.Addr().String(), 0, func(conn *TCPConn, err error) {
+		t.Errorf(`DialEvent was called after Close: %v`, err)
+	})
+	if err != ErrServerClosed {
+		t.Fatalf(`Dial after Close returned wrong error: %v`, err)
+	}
+}
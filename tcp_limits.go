@@ -0,0 +1,188 @@
+package gonetz
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	// acceptRetryOnClose - прием приостановлен до закрытия одного из соединений (см. acceptNext)
+	acceptRetryOnClose = time.Duration(-1)
+)
+
+type (
+	// acceptLimiter - token bucket для ServerOptions.AcceptRate.
+	// Общий для всех принимающих горутин (Start или воркеров в режиме ReusePort)
+	acceptLimiter struct {
+		mu     sync.Mutex
+		rate   float64 // accept в секунду, он же максимальный запас
+		tokens float64
+		last   time.Time
+	}
+)
+
+func newAcceptLimiter(rate int) *acceptLimiter {
+	return &acceptLimiter{rate: float64(rate), tokens: float64(rate)}
+}
+
+// take забирает разрешение на один accept.
+// Если разрешений нет, то возвращает время до появления следующего
+func (l *acceptLimiter) take(now time.Time) (wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+
+	wait = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if wait < time.Millisecond {
+		// точнее epoll все равно ждать не умеет
+		wait = time.Millisecond
+	}
+	return wait
+}
+
+// refund возвращает неиспользованное разрешение (accept не нашел соединения)
+func (l *acceptLimiter) refund() {
+	l.mu.Lock()
+	if l.tokens++; l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.mu.Unlock()
+}
+
+// Rejected возвращает количество соединений, закрытых сразу после accept
+// из-за ServerOptions.MaxConnections или AccessRules, а также без корректного заголовка PROXY protocol
+func (srv *TCPServer) Rejected() uint64 {
+	return atomic.LoadUint64(&srv.rejected)
+}
+
+// acceptNext принимает очередное соединение на listenFd с учетом ServerOptions.MaxConnections и AcceptRate.
+// Соединения сверх MaxConnections с RejectExcess закрываются здесь же.
+// При errno == EAGAIN retry сообщает, когда повторить попытку, т.к. в очереди ядра могли остаться соединения,
+// о которых edge-triggered epoll повторно не сообщит: 0 - не нужно (ждать события epoll),
+// acceptRetryOnClose - после закрытия какого-либо соединения (придет Wakeup), иначе - через retry
+func (srv *TCPServer) acceptNext(listenFd int, addr *sockaddrBuf) (clientFd int, retry time.Duration, errno syscall.Errno) {
+	limitBacklog := (srv.options.MaxConnections > 0) && !srv.options.RejectExcess
+
+	for {
+		if srv.acceptLimit != nil {
+			if retry = srv.acceptLimit.take(time.Now()); retry > 0 {
+				return 0, retry, syscall.EAGAIN
+			}
+		}
+
+		// в режиме очереди ядра место под соединение резервирую до accept, чтобы не принять лишнее
+		if limitBacklog && !srv.reserveConnOrBlock() {
+			if srv.acceptLimit != nil {
+				srv.acceptLimit.refund()
+			}
+			return 0, acceptRetryOnClose, syscall.EAGAIN
+		}
+
+		if clientFd, errno = acceptFd(listenFd, addr); errno != 0 {
+			if limitBacklog {
+				srv.releaseConn()
+			}
+			if srv.acceptLimit != nil {
+				srv.acceptLimit.refund()
+			}
+			return 0, 0, errno
+		}
+
+		if !limitBacklog && !srv.reserveConn() {
+			srv.rejectConn(clientFd, srv.options.RejectMessage)
+			continue
+		}
+
+		return clientFd, 0, 0
+	}
+}
+
+// reserveConn учитывает новое входящее соединение, если это позволяет ServerOptions.MaxConnections
+func (srv *TCPServer) reserveConn() bool {
+	limit := int32(srv.options.MaxConnections)
+
+	for {
+		cnt := atomic.LoadInt32(&srv.conns)
+		if (limit > 0) && (cnt >= limit) {
+			return false
+		} else if atomic.CompareAndSwapInt32(&srv.conns, cnt, cnt+1) {
+			return true
+		}
+	}
+}
+
+// reserveConnOrBlock аналогичен reserveConn, но при неудаче просит releaseConn разбудить принимающие горутины
+func (srv *TCPServer) reserveConnOrBlock() bool {
+	if srv.reserveConn() {
+		return true
+	}
+
+	atomic.StoreInt32(&srv.acceptBlocked, 1)
+	// соединение могло закрыться между проверкой и установкой флага
+	return srv.reserveConn()
+}
+
+// releaseConn освобождает место, занятое reserveConn
+func (srv *TCPServer) releaseConn() {
+	atomic.AddInt32(&srv.conns, -1)
+
+	if !atomic.CompareAndSwapInt32(&srv.acceptBlocked, 1, 0) {
+		return
+	} else if !srv.options.ReusePort {
+		_ = srv.epoll.Wakeup()
+		return
+	}
+
+	for i := range srv.workerPool.epolls {
+		_ = srv.workerPool.epolls[i].Wakeup()
+	}
+}
+
+// rejectConn закрывает только что принятое соединение, отправив msg (если задано)
+func (srv *TCPServer) rejectConn(clientFd int, msg []byte) {
+	atomic.AddUint64(&srv.rejected, 1)
+
+	if len(msg) > 0 {
+		// принятый сокет еще блокирующий, а ждать клиента в цикле приема нельзя: MSG_DONTWAIT,
+		// и что не влезло в буфер отправки, то отбрасывается
+		_, _, _ = syscall.Syscall6(
+			syscall.SYS_SENDTO,
+			uintptr(clientFd),
+			uintptr(unsafe.Pointer(&msg[0])),
+			uintptr(len(msg)),
+			syscall.MSG_DONTWAIT|syscall.MSG_NOSIGNAL,
+			0, 0,
+		)
+	}
+
+	_, _, _ = syscall.Syscall(syscall.SYS_CLOSE, uintptr(clientFd), 0, 0)
+}
+
+// retryTimeout сокращает таймаут epoll так, чтобы проснуться к at
+func retryTimeout(timeout Millisecond, at, now time.Time) Millisecond {
+	d := at.Sub(now)
+	if d <= 0 {
+		return 0
+	}
+
+	ms := Millisecond((d + time.Millisecond - 1) / time.Millisecond)
+	if (timeout < 0) || (ms < timeout) {
+		return ms
+	}
+	return timeout
+}
@@ -0,0 +1,225 @@
+package gonetz
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_acceptLimiter(t *testing.T) {
+	l := newAcceptLimiter(2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if wait := l.take(now); wait != 0 {
+			t.Fatalf(`take #%d must be allowed, got wait %s`, i, wait)
+		}
+	}
+
+	if wait := l.take(now); (wait < 490*time.Millisecond) || (wait > 500*time.Millisecond) {
+		t.Fatalf(`wrong wait for exhausted limiter: %s`, wait)
+	}
+
+	l.refund()
+	if wait := l.take(now); wait != 0 {
+		t.Fatalf(`refunded take must be allowed, got wait %s`, wait)
+	}
+
+	if wait := l.take(now.Add(500 * time.Millisecond)); wait != 0 {
+		t.Fatalf(`take after refill must be allowed, got wait %s`, wait)
+	}
+
+	// запас не превышает rate
+	if wait := l.take(now.Add(1 * time.Hour)); wait != 0 {
+		t.Fatalf(`take after long pause must be allowed`)
+	}
+	l.take(now.Add(1 * time.Hour))
+	if wait := l.take(now.Add(1 * time.Hour)); wait == 0 {
+		t.Fatalf(`limiter must not accumulate more than rate`)
+	}
+}
+
+func startLimitsServer(t *testing.T, opts ServerOptions) (addr string, connected chan *TCPConn, stop func()) {
+	srv, addr := newTestServer(t, opts)
+
+	connected = make(chan *TCPConn, 16)
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		connected <- conn
+		return true
+	})
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		conn.RdBuf.Clean()
+		return true
+	})
+
+	return addr, connected, startTestServer(t, srv)
+}
+
+func Test_TCPServer_MaxConnections_1(t *testing.T) {
+	for _, reusePort := range []bool{false, true} {
+		addr, connected, stop := startLimitsServer(t, ServerOptions{
+			Workers:        2,
+			ReusePort:      reusePort,
+			MaxConnections: 2,
+		})
+		defer stop()
+
+		var clients []net.Conn
+		for i := 0; i < 3; i++ {
+			client, err := net.DialTimeout(`tcp`, addr, 1*time.Second)
+			if err != nil {
+				t.Fatalf(`Could not dial to server: %s`, err)
+			}
+			defer client.Close()
+			clients = append(clients, client)
+		}
+
+		for i := 0; i < 2; i++ {
+			select {
+			case <-connected:
+			case <-time.After(1 * time.Second):
+				t.Fatalf(`[reuseport=%v] connection #%d was not accepted`, reusePort, i)
+			}
+		}
+
+		select {
+		case <-connected:
+			t.Fatalf(`[reuseport=%v] connection over MaxConnections was accepted`, reusePort)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		// освободившееся место занимает соединение из очереди ядра
+		_ = clients[0].Close()
+
+		select {
+		case <-connected:
+		case <-time.After(1 * time.Second):
+			t.Fatalf(`[reuseport=%v] waiting connection was not accepted after close`, reusePort)
+		}
+	}
+}
+
+func Test_TCPServer_MaxConnections_2(t *testing.T) {
+	srv, addr := newTestServer(t, ServerOptions{
+		Workers:        1,
+		MaxConnections: 1,
+		RejectExcess:   true,
+		RejectMessage:  []byte("busy\n"),
+	})
+
+	connected := make(chan bool, 2)
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		connected <- true
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client1, err := net.DialTimeout(`tcp`, addr, 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client1.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`first connection was not accepted`)
+	}
+
+	client2, err := net.DialTimeout(`tcp`, addr, 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client2.Close()
+
+	_ = client2.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if data, err := ioutil.ReadAll(client2); err != nil {
+		t.Fatalf(`Could not read from rejected connection: %s`, err)
+	} else if string(data) != "busy\n" {
+		t.Fatalf(`unexpected reject message: %q`, data)
+	}
+
+	if rejected := srv.Rejected(); rejected != 1 {
+		t.Fatalf(`wrong rejected counter: %d`, rejected)
+	}
+
+	select {
+	case <-connected:
+		t.Fatalf(`OnClientConnect was called for rejected connection`)
+	default:
+	}
+}
+
+// Тест на RejectMessage больше буфера отправки: клиент его не читает, а прием остальных соединений не блокируется
+func Test_TCPServer_MaxConnections_3(t *testing.T) {
+	srv, addr := newTestServer(t, ServerOptions{
+		Workers:        1,
+		MaxConnections: 1,
+		RejectExcess:   true,
+		RejectMessage:  make([]byte, 64*1024*1024),
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		client, err := net.DialTimeout(`tcp`, addr, 1*time.Second)
+		if err != nil {
+			t.Fatalf(`Could not dial to server: %s`, err)
+		}
+		defer client.Close()
+	}
+
+	for deadline := time.Now().Add(2 * time.Second); srv.Rejected() != 2; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf(`accept is blocked by reject message: rejected %d connections, expect 2`, srv.Rejected())
+		}
+	}
+}
+
+func Test_TCPServer_AcceptRate(t *testing.T) {
+	const (
+		rate  = 5
+		total = rate + 2
+	)
+
+	addr, connected, stop := startLimitsServer(t, ServerOptions{
+		Workers:    1,
+		AcceptRate: rate,
+	})
+	defer stop()
+
+	for i := 0; i < total; i++ {
+		client, err := net.DialTimeout(`tcp`, addr, 1*time.Second)
+		if err != nil {
+			t.Fatalf(`Could not dial to server: %s`, err)
+		}
+		defer client.Close()
+	}
+
+	for i := 0; i < rate; i++ {
+		select {
+		case <-connected:
+		case <-time.After(1 * time.Second):
+			t.Fatalf(`connection #%d was not accepted`, i)
+		}
+	}
+
+	select {
+	case <-connected:
+		t.Fatalf(`connection over AcceptRate was accepted immediately`)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// следующие разрешения появляются раз в 1/rate секунды
+	for i := rate; i < total; i++ {
+		select {
+		case <-connected:
+		case <-time.After(1 * time.Second):
+			t.Fatalf(`connection #%d was not accepted after pause`, i)
+		}
+	}
+}
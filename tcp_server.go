@@ -1,91 +1,389 @@
 package gonetz
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
 const (
-//SO_REUSEPORT = 15 // missing in stdlib
+	// SO_REUSEPORT отсутствует в syscall
+	SO_REUSEPORT = 15
+
+	// defaultReadBufferSize - размер буфера воркера для чтения из сокетов по умолчанию
+	defaultReadBufferSize = 32 * 1024
+
+	// maxReadsPerEvent ограничивает число чтений из одного сокета за одно событие,
+	// чтобы активный клиент не мешал обработке остальных соединений воркера
+	maxReadsPerEvent = 16
+
+	// DefaultTLSHandshakeTimeout - ограничение длительности TLS handshake по умолчанию (см. ServerOptions.TLSHandshakeTimeout)
+	DefaultTLSHandshakeTimeout = 10 * time.Second
+	// DefaultTLSMaxHandshakes - ограничение количества одновременных TLS handshake по умолчанию (см. ServerOptions.TLSMaxHandshakes)
+	DefaultTLSMaxHandshakes = 256
 )
 
 type (
-	// ConnEvent - это callback на собыия на сокете (пок что только на чтение (OnClientRead))
+	// ConnEvent - это callback на собыия на сокете (подключение (OnClientConnect), чтение (OnClientRead)
+	// и запись (OnClientWrite)).
+	// Если callback вернет false, то соединение будет закрыто после отправки всех данных из WrBuf
+	// (аналогично вызову TCPConn.CloseAfterFlush)
 	ConnEvent func(conn *TCPConn) bool
 
+	// CloseEvent - это callback на закрытие соединения (OnClientClose)
+	CloseEvent func(conn *TCPConn, reason CloseReason)
+
+	// CloseReason - причина закрытия соединения
+	CloseReason int
+
+	// ServerOptions - настройки сервера для NewServerWithOptions.
+	// Нулевые значения полей заменяются значениями по умолчанию
+	ServerOptions struct {
+		// Host и Port - адрес, на котором сервер принимает соединения.
+		// Host может быть как IPv4, так и IPv6 адресом (в т.ч. с зоной: fe80::1%eth0). По умолчанию 0.0.0.0
+		Host string
+		Port uint
+		// IPv6Only запрещает IPv6 сокету принимать IPv4 соединения (IPV6_V6ONLY).
+		// По умолчанию сокет на :: принимает соединения обоих семейств
+		IPv6Only bool
+
+		// Network - "tcp" (по умолчанию) или "unix".
+		// Для "unix" Host - это путь к сокету (либо имя в abstract namespace с префиксом @), а Port игнорируется
+		Network string
+		// UnixSocketMode - права на файл unix сокета. По умолчанию определяются umask
+		UnixSocketMode os.FileMode
+
+		// ReusePort включает режим, в котором каждый воркер принимает соединения на собственном слушающем сокете
+		// с SO_REUSEPORT, а балансировку между воркерами делает ядро. Только для tcp
+		ReusePort bool
+
+		// Workers - количество воркеров (epoll + горутина). По умолчанию runtime.GOMAXPROCS(0)
+		Workers uint
+		// ReadBufferSize - размер буфера каждого воркера для чтения из сокетов. По умолчанию 32 KiB
+		ReadBufferSize int
+		// ListenBacklog - размер очереди еще не принятых соединений (listen backlog). По умолчанию 2048
+		ListenBacklog int
+		// EPollEvents - максимальное количество событий, получаемых за один EPoll.Wait. По умолчанию 2048
+		EPollEvents int
+		// WaitTimeout - таймаут EPoll.Wait для всех epoll сервера. По умолчанию DefaultEPollWaitTimeout
+		WaitTimeout Millisecond
+
+		// IdleTimeout, ReadTimeout и WriteTimeout - таймауты соединений по умолчанию (0 - без ограничения),
+		// см. TCPConn.SetIdleTimeout, TCPConn.SetReadTimeout и TCPConn.SetWriteTimeout
+		IdleTimeout  time.Duration
+		ReadTimeout  time.Duration
+		WriteTimeout time.Duration
+
+		// ReadHighWater и ReadLowWater - пороги RdBuf по умолчанию для приостановки чтения из сокета
+		// (0 - без ограничения), см. TCPConn.SetReadWatermarks
+		ReadHighWater int
+		ReadLowWater  int
+
+		// WriteBufferLimit и WriteLowWater - ограничение размера WrBuf по умолчанию (0 - без ограничения)
+		// и порог для OnClientWriteLowWater, см. TCPConn.SetWriteBufferLimit
+		WriteBufferLimit int
+		WriteLowWater    int
+
+		// MaxConnections - ограничение количества одновременно обслуживаемых входящих соединений (0 - без ограничения).
+		// Сверх него соединения ждут в очереди ядра (listen backlog), пока не закроется одно из текущих
+		MaxConnections int
+		// RejectExcess - вместо ожидания в очереди ядра принимать соединения сверх MaxConnections
+		// и сразу закрывать, отправив RejectMessage (если задано). См. TCPServer.Rejected
+		RejectExcess bool
+		// RejectMessage отправляется соединениям, закрытым из-за MaxConnections или AccessRules.MaxPerIP
+		RejectMessage []byte
+		// AcceptRate - ограничение количества принимаемых соединений в секунду (0 - без ограничения).
+		// Сверх него соединения ждут в очереди ядра
+		AcceptRate int
+
+		// TLSConfig включает TLS для входящих соединений (в т.ч. выбор сертификата по SNI через Certificates
+		// или GetCertificate и ALPN через NextProtos). Обработчики соединения работают с расшифрованными данными,
+		// а OnClientConnect вызывается только после успешного handshake (см. TCPConn.TLSState).
+		// crypto/tls не умеет неблокирующий handshake, так что каждый handshake выполняется в отдельной горутине,
+		// которая живет до его завершения или закрытия соединения (см. TLSHandshakeTimeout и TLSMaxHandshakes)
+		TLSConfig *tls.Config
+		// TLSHandshakeTimeout ограничивает длительность TLS handshake независимо от IdleTimeout и ReadTimeout:
+		// по его истечении соединение закрывается, не дойдя до OnClientConnect.
+		// По умолчанию DefaultTLSHandshakeTimeout, отрицательное значение - без ограничения
+		TLSHandshakeTimeout time.Duration
+		// TLSMaxHandshakes ограничивает количество одновременных TLS handshake, т.е. и их горутин.
+		// Соединения сверх него ждут своей очереди, не читая данные из сокета (TLSHandshakeTimeout для них уже идет).
+		// По умолчанию DefaultTLSMaxHandshakes, отрицательное значение - без ограничения
+		TLSMaxHandshakes int
+
+		// ProxyProtocol включает разбор заголовка PROXY protocol v1/v2, который балансировщик (HAProxy, AWS NLB)
+		// отправляет в начале соединения. Адреса из заголовка заменяют RemoteAddr и LocalAddr соединения
+		// (см. TCPConn.ProxyHeader), а OnClientConnect вызывается только после получения заголовка.
+		// AccessRules применяются к адресу самого балансировщика
+		ProxyProtocol ProxyProtocolMode
+	}
+
 	// TCPServer реализует TPC сервер
 	TCPServer struct {
-		closed bool
-		fd     int
-		epoll  EPoll
+		closed   int32 // меняется атомарно
+		shutdown int32 // меняется атомарно, см. Shutdown
+		fd       int
+		family   int // семейство адресов слушающего сокета (AF_INET, AF_INET6, AF_UNIX)
+		epoll    EPoll
+
+		// epoll закрывает Start при выходе, а если Start не запущен, то Close (см. closeEpoll)
+		epollMu     sync.Mutex
+		started     bool
+		epollClosed bool
+
+		options  ServerOptions
+		unixPath string // файл unix сокета, который нужно удалить при остановке
 
 		workerPool workerPool
+		workersWg  sync.WaitGroup // работающие горутины воркеров
 
-		acceptAddr struct {
-			syscall.RawSockaddrAny
-			Ptr    uintptr
-			Len    uint32
-			LenPtr uintptr
-		}
+		listenerOnce sync.Once
+		listenMu     sync.Mutex // защищает fd от закрытия в closeListener во время accept в Start
 
-		clients map[int]*TCPConn
+		acceptAddr sockaddrBuf
+		addr       net.Addr // адрес слушающего сокета
+		localAddr  net.Addr // addr, если он общий для всех соединений (см. TCPConn.LocalAddr)
+
+		conns         int32  // меняется атомарно, входящие соединения, учитываемые в MaxConnections
+		acceptBlocked int32  // меняется атомарно, прием ждет закрытия соединения (см. reserveConnOrBlock)
+		rejected      uint64 // меняется атомарно, см. Rejected
+		lastConnID    uint64 // меняется атомарно, см. TCPConn.ID
+		acceptLimit   *acceptLimiter
+
+		access atomic.Value // *accessRules, см. SetAccessRules
+		peers  peerCounter
+
+		tlsHandshakes tlsLimiter // см. ServerOptions.TLSMaxHandshakes
+
+		cnEvent ConnEvent
 		rdEvent ConnEvent
 		wrEvent ConnEvent
+		wlEvent ConnEvent
+		efEvent ConnEvent
+		clEvent CloseEvent
+	}
+
+	// sockaddrBuf - буфер под адрес клиента для accept
+	sockaddrBuf struct {
+		syscall.RawSockaddrAny
+		Ptr    uintptr
+		Len    uint32
+		LenPtr uintptr
 	}
 
 	workerPool struct {
 		fds           []int
 		epolls        []EPoll
-		nextWorkerIdx int
+		workers       []tcpWorker
+		nextWorkerIdx uint32 // меняется атомарно, т.к. воркер выбирают и Start, и Dial
 	}
 )
 
+const (
+	// CloseReasonEOF - клиент закрыл соединение со своей стороны
+	CloseReasonEOF CloseReason = iota
+	// CloseReasonReset - соединение сброшено (ECONNRESET, EPIPE)
+	CloseReasonReset
+	// CloseReasonError - ошибка на сокете (EPOLLHUP, EPOLLERR и прочие ошибки чтения/записи)
+	CloseReasonError
+	// CloseReasonServer - соединение закрыто при остановке сервера
+	CloseReasonServer
+	// CloseReasonHandler - соединение закрыто обработчиком
+	CloseReasonHandler
+	// CloseReasonTimeout - истек один из таймаутов соединения
+	CloseReasonTimeout
+	// CloseReasonProtocol - данные клиента нарушают формат протокола (например, слишком большой кадр FrameCodec)
+	CloseReasonProtocol
+)
+
 var (
 	// ErrWrongHost возвращается при некорректном имени хоста в качестве listen адреса
 	ErrWrongHost = fmt.Errorf(`wrong host`)
 	// ErrWrongPoolSize возвращается при попытке создать пустой пул воркеров
 	ErrWrongPoolSize = fmt.Errorf(`wrong pool size`)
+	// ErrWrongNetwork возвращается при неподдерживаемом ServerOptions.Network
+	ErrWrongNetwork = fmt.Errorf(`wrong network`)
+	// ErrBufferFull возвращается TCPConn.Write, если данные не влезают в ограничение WrBuf
+	ErrBufferFull = fmt.Errorf(`write buffer is full`)
+	// ErrTLSHandshake возвращается TCPConn.Write, если TLS соединение еще не установлено
+	ErrTLSHandshake = fmt.Errorf(`tls handshake is not complete`)
+	// ErrServerClosed возвращается Dial после Close или Shutdown сервера
+	ErrServerClosed = fmt.Errorf(`server is closed`)
+	// ErrConnClosed возвращается TCPConn.Write после закрытия соединения (например, из fn, переданной в Post)
+	ErrConnClosed = fmt.Errorf(`connection is closed`)
 )
 
-// NewServer создает новый сервер на указанном адресе и порту
+// NewServer создает новый сервер на указанном адресе и порту с настройками по умолчанию
 func NewServer(host string, port uint) (srv *TCPServer, err error) {
-	srv = &TCPServer{}
+	return NewServerWithOptions(ServerOptions{Host: host, Port: port})
+}
+
+// NewServerWithOptions создает новый сервер с указанными настройками
+func NewServerWithOptions(opts ServerOptions) (srv *TCPServer, err error) {
+	opts.setDefaults()
+
+	srv = &TCPServer{options: opts}
+	if opts.AcceptRate > 0 {
+		srv.acceptLimit = newAcceptLimiter(opts.AcceptRate)
+	}
+	srv.tlsHandshakes.max = srv.tlsMaxHandshakes()
+
+	if (opts.Network == `unix`) && opts.ReusePort {
+		err = ErrWrongNetwork
+	} else if opts.Network == `unix` {
+		err = srv.newListenerUnix(opts.Host)
+	} else if opts.Network == `` || opts.Network == `tcp` {
+		err = srv.newListener(opts.Host, opts.Port)
+	} else {
+		err = ErrWrongNetwork
+	}
 
-	if err = srv.newListenerIPv4(host, port); err != nil {
+	if err != nil {
 		return nil, err
-	} else if err = srv.setupServerWorkers(1); err != nil {
+	}
+
+	srv.setupLocalAddr()
+
+	if err = srv.setupServerWorkers(opts.Workers); err != nil {
 		srv.Close()
 		return nil, err
 	}
 
 	srv.setupAcceptAddr()
 
-	srv.clients = make(map[int]*TCPConn)
-
 	// Заглушка, чтобы не проверять на nil в основном цикле
 	srv.rdEvent = func(conn *TCPConn) bool {
 		return true
 	}
+	srv.wrEvent = srv.rdEvent
+	srv.wlEvent = srv.rdEvent
+	srv.cnEvent = srv.rdEvent
+	srv.efEvent = func(conn *TCPConn) bool {
+		return false
+	}
+	srv.clEvent = func(conn *TCPConn, reason CloseReason) {}
 
 	return srv, err
 }
 
+// OnClientConnect заменяет обработчик нового соединения.
+// Вызывается до регистрации соединения в воркере
+func (srv *TCPServer) OnClientConnect(event ConnEvent) {
+	srv.cnEvent = event
+}
+
+// OnClientClose заменяет обработчик закрытия соединения.
+// Вызывается ровно один раз для каждого принятого соединения, для которого был вызван OnClientConnect,
+// и для каждого соединения, успешно установленного через Dial
+func (srv *TCPServer) OnClientClose(event CloseEvent) {
+	srv.clEvent = event
+}
+
 // OnClientRead заменяет обработчик получения новых данных по соединению
 func (srv *TCPServer) OnClientRead(event ConnEvent) {
 	srv.rdEvent = event
 }
 
-//func (srv *TCPServer) OnClientWrite(event ConnEvent) {
-//	srv.wrEvent = event
-//}
+// OnClientWrite заменяет обработчик полной отправки отложенных данных из WrBuf
+func (srv *TCPServer) OnClientWrite(event ConnEvent) {
+	srv.wrEvent = event
+}
+
+// OnClientWriteLowWater заменяет обработчик опускания WrBuf до нижнего порога (см. TCPConn.SetWriteBufferLimit).
+// Вызывается один раз после каждого превышения порога, в т.ч. после отказа Write с ErrBufferFull
+func (srv *TCPServer) OnClientWriteLowWater(event ConnEvent) {
+	srv.wlEvent = event
+}
+
+// OnClientEOF заменяет обработчик закрытия клиентом своей стороны соединения (FIN).
+// Данные, пришедшие до FIN, к этому моменту уже переданы в OnClientRead, а новых больше не будет.
+// По умолчанию (и если обработчик вернет false) соединение закрывается с CloseReasonEOF после отправки WrBuf.
+// true оставляет соединение открытым для записи до явного закрытия (половинчатое закрытие, как CloseWrite у клиента)
+func (srv *TCPServer) OnClientEOF(event ConnEvent) {
+	srv.efEvent = event
+}
+
+func (opts *ServerOptions) setDefaults() {
+	if opts.Workers == 0 {
+		opts.Workers = uint(runtime.GOMAXPROCS(0))
+	}
+	// остальные значения по умолчанию подставляются при использовании (см. listenBacklog, readBufferSize, initEpoll)
+}
+
+func (srv *TCPServer) listenBacklog() int {
+	if srv.options.ListenBacklog > 0 {
+		return srv.options.ListenBacklog
+	}
+	return maxEpollEvents
+}
+
+func (srv *TCPServer) tlsHandshakeTimeout() time.Duration {
+	if srv.options.TLSHandshakeTimeout != 0 {
+		return srv.options.TLSHandshakeTimeout
+	}
+	return DefaultTLSHandshakeTimeout
+}
+
+func (srv *TCPServer) tlsMaxHandshakes() int {
+	if srv.options.TLSMaxHandshakes != 0 {
+		return srv.options.TLSMaxHandshakes
+	}
+	return DefaultTLSMaxHandshakes
+}
+
+func (srv *TCPServer) readBufferSize() int {
+	if srv.options.ReadBufferSize > 0 {
+		return srv.options.ReadBufferSize
+	}
+	return defaultReadBufferSize
+}
+
+// setupLocalAddr запоминает адрес слушающего сокета и то, будет ли он локальным адресом всех соединений
+func (srv *TCPServer) setupLocalAddr() {
+	sa, err := syscall.Getsockname(srv.fd)
+	if err != nil {
+		return
+	}
+
+	srv.addr = sockaddrToNetAddr(sa)
+	if tcpAddr, ok := srv.addr.(*net.TCPAddr); ok && tcpAddr.IP.IsUnspecified() {
+		// соединения могут приходить на любой из адресов машины
+		return
+	}
+	srv.localAddr = srv.addr
+}
+
+// Addr возвращает адрес, на котором сервер принимает соединения (с выбранным ядром портом при Port == 0)
+func (srv *TCPServer) Addr() net.Addr {
+	return srv.addr
+}
 
 func (srv *TCPServer) setupAcceptAddr() {
-	srv.acceptAddr.Ptr = uintptr(unsafe.Pointer(&srv.acceptAddr.RawSockaddrAny))
-	srv.acceptAddr.Len = syscall.SizeofSockaddrAny
-	srv.acceptAddr.LenPtr = uintptr(unsafe.Pointer(&srv.acceptAddr.Len))
+	srv.acceptAddr.setup()
+}
+
+func (buf *sockaddrBuf) setup() {
+	buf.Ptr = uintptr(unsafe.Pointer(&buf.RawSockaddrAny))
+	buf.Len = syscall.SizeofSockaddrAny
+	buf.LenPtr = uintptr(unsafe.Pointer(&buf.Len))
+}
+
+// newListener создает слушающий сокет IPv4 или IPv6 в зависимости от listenAddr
+func (srv *TCPServer) newListener(listenAddr string, listenPort uint) (err error) {
+	if ip := net.ParseIP(listenAddr); (listenAddr == ``) || (ip.To4() != nil) {
+		return srv.newListenerIPv4(listenAddr, listenPort)
+	}
+	return srv.newListenerIPv6(listenAddr, listenPort)
 }
 
 func (srv *TCPServer) newListenerIPv4(listenAddr string, listenPort uint) (err error) {
@@ -93,28 +391,69 @@ func (srv *TCPServer) newListenerIPv4(listenAddr string, listenPort uint) (err e
 		listenAddr = `0.0.0.0`
 	}
 
-	ip := net.ParseIP(listenAddr)
+	ip := net.ParseIP(listenAddr).To4()
 	if len(ip) == 0 {
 		return ErrWrongHost
 	}
 
 	addr := syscall.SockaddrInet4{Port: int(listenPort)}
-	copy(addr.Addr[:], ip.To4())
+	copy(addr.Addr[:], ip)
+
+	return srv.listen(syscall.AF_INET, &addr)
+}
+
+// newListenerIPv6 создает слушающий сокет IPv6.
+// Поддерживаются адреса с зоной (fe80::1%eth0). Прием IPv4 соединений управляется ServerOptions.IPv6Only
+func (srv *TCPServer) newListenerIPv6(listenAddr string, listenPort uint) (err error) {
+	if listenAddr == `` {
+		listenAddr = `::`
+	}
+
+	var zone string
+	if pos := strings.LastIndexByte(listenAddr, '%'); pos != -1 {
+		listenAddr, zone = listenAddr[:pos], listenAddr[pos+1:]
+	}
+
+	ip := net.ParseIP(listenAddr)
+	if (len(ip) != net.IPv6len) || (ip.To4() != nil) {
+		return ErrWrongHost
+	}
+
+	addr := syscall.SockaddrInet6{Port: int(listenPort)}
+	copy(addr.Addr[:], ip)
 
+	if zone == `` {
+	} else if zoneID, ok := ipv6ZoneID(zone); !ok {
+		return ErrWrongHost
+	} else {
+		addr.ZoneId = zoneID
+	}
+
+	return srv.listen(syscall.AF_INET6, &addr)
+}
+
+// ipv6ZoneID возвращает индекс интерфейса по зоне IPv6 адреса (имя интерфейса или его номер)
+func ipv6ZoneID(zone string) (uint32, bool) {
+	if iface, err := net.InterfaceByName(zone); err == nil {
+		return uint32(iface.Index), true
+	} else if idx, err := strconv.ParseUint(zone, 10, 32); err == nil {
+		return uint32(idx), true
+	}
+	return 0, false
+}
+
+func (srv *TCPServer) listen(family int, addr syscall.Sockaddr) (err error) {
 	serverFd := 0
 
-	if serverFd, err = syscallWrappers.Socket(syscall.AF_INET, syscall.O_NONBLOCK|syscall.SOCK_STREAM, 0); err != nil {
+	if serverFd, err = srv.newListenSocket(family, addr); err != nil {
 		return err
-	} else if err = syscallWrappers.SetNonblock(serverFd, true); err != nil {
-		//} else if err = syscall.SetsockoptInt(serverFd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
-		//} else if err = syscall.SetsockoptInt(serverFd, syscall.SOL_SOCKET, SO_REUSEPORT, 1); err != nil {
-	} else if err = syscallWrappers.SetsockoptInt(serverFd, syscall.SOL_TCP, syscall.TCP_NODELAY, 1); err != nil { // ?
-	} else if err = syscallWrappers.SetsockoptInt(serverFd, syscall.SOL_TCP, syscall.TCP_QUICKACK, 1); err != nil {
-	} else if err = syscallWrappers.Bind(serverFd, &addr); err != nil {
-	} else if err = syscallWrappers.Listen(serverFd, maxEpollEvents); err != nil {
 	} else if err = InitServerEpoll(serverFd, &srv.epoll); err != nil {
 	} else {
+		if srv.options.WaitTimeout != 0 {
+			srv.epoll.WaitTimeout = srv.options.WaitTimeout
+		}
 		srv.fd = serverFd
+		srv.family = family
 		return nil
 	}
 
@@ -124,26 +463,96 @@ func (srv *TCPServer) newListenerIPv4(listenAddr string, listenPort uint) (err e
 	return err
 }
 
+// newListenSocket создает слушающий сокет, но не добавляет его ни в какой epoll
+func (srv *TCPServer) newListenSocket(family int, addr syscall.Sockaddr) (serverFd int, err error) {
+	if serverFd, err = syscallWrappers.Socket(family, syscall.O_NONBLOCK|syscall.SOCK_STREAM, 0); err != nil {
+		return 0, err
+	} else if err = syscallWrappers.SetNonblock(serverFd, true); err != nil {
+		//} else if err = syscall.SetsockoptInt(serverFd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+	} else if err = srv.setupListenerOptions(serverFd, family); err != nil {
+	} else if err = syscallWrappers.Bind(serverFd, addr); err != nil {
+	} else if err = srv.setupUnixSocketMode(addr); err != nil {
+	} else if err = syscallWrappers.Listen(serverFd, srv.listenBacklog()); err != nil {
+	} else {
+		return serverFd, nil
+	}
+
+	// something went wrong
+	_ = syscall.Close(serverFd)
+
+	return 0, err
+}
+
+// setupListenerOptions настраивает TCP опции слушающего сокета.
+// Для IPv6 явно выставляется IPV6_V6ONLY, чтобы не полагаться на системный net.ipv6.bindv6only
+func (srv *TCPServer) setupListenerOptions(serverFd int, family int) (err error) {
+	if family == syscall.AF_UNIX {
+		return nil
+	}
+
+	v6only := 0
+	if srv.options.IPv6Only {
+		v6only = 1
+	}
+
+	if err = syscallWrappers.SetsockoptInt(serverFd, syscall.SOL_TCP, syscall.TCP_NODELAY, 1); err != nil { // ?
+	} else if err = syscallWrappers.SetsockoptInt(serverFd, syscall.SOL_TCP, syscall.TCP_QUICKACK, 1); err != nil {
+	} else if !srv.options.ReusePort {
+	} else if err = syscallWrappers.SetsockoptInt(serverFd, syscall.SOL_SOCKET, SO_REUSEPORT, 1); err != nil {
+	}
+
+	if (err != nil) || (family != syscall.AF_INET6) {
+	} else if err = syscallWrappers.SetsockoptInt(serverFd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, v6only); err != nil {
+	}
+
+	return err
+}
+
 func (srv *TCPServer) setupServerWorkers(poolSize uint) (err error) {
 	if poolSize < 1 {
 		return ErrWrongPoolSize
 	}
 
+	var reuseAddr syscall.Sockaddr
+	if srv.options.ReusePort {
+		// при Port == 0 ядро уже выбрало порт, и остальные воркеры должны слушать именно его
+		if reuseAddr, err = syscall.Getsockname(srv.fd); err != nil {
+			return err
+		}
+	}
+
 	pool := &srv.workerPool
 
 	pool.fds = make([]int, poolSize)
 	pool.epolls = make([]EPoll, poolSize)
+	pool.workers = make([]tcpWorker, poolSize)
 
 	for i := 0; i < int(poolSize); i++ {
 		epoll := &pool.epolls[i]
 
-		if err = InitClientEpoll(epoll); err != nil {
+		if err = initEpoll(epoll, srv.options.EPollEvents); err != nil {
 			return err
 		}
+		if srv.options.WaitTimeout != 0 {
+			epoll.WaitTimeout = srv.options.WaitTimeout
+		}
 		pool.fds[i] = epoll.fd
 
+		worker := &pool.workers[i]
+		worker.init(srv, epoll)
+
+		if !srv.options.ReusePort {
+		} else if err = srv.setupWorkerListener(worker, reuseAddr); err != nil {
+			// горутина воркера еще не запущена, так что его epoll больше никто не закроет
+			_ = epoll.Close()
+			return err
+		}
+
+		srv.workersWg.Add(1)
 		go func() {
-			err := srv.startWorkerLoop(epoll)
+			defer srv.workersWg.Done()
+
+			err := srv.startWorkerLoop(worker)
 			if err != nil {
 				// ToDo: log
 			}
@@ -153,11 +562,78 @@ func (srv *TCPServer) setupServerWorkers(poolSize uint) (err error) {
 	return nil
 }
 
-// Start блокирующе запускает обработку новых соединений
+// setupWorkerListener выдает воркеру собственный слушающий сокет для режима ServerOptions.ReusePort.
+// Первый воркер забирает основной сокет сервера, остальным создаются новые на том же адресе
+func (srv *TCPServer) setupWorkerListener(w *tcpWorker, addr syscall.Sockaddr) (err error) {
+	listenFd := srv.fd
+
+	if listenFd != 0 {
+		if err = srv.epoll.DeleteFd(listenFd); err != nil {
+			return err
+		}
+		// теперь сокетом владеет воркер, а Start только ждет остановки сервера
+		srv.fd = 0
+	} else if listenFd, err = srv.newListenSocket(srv.family, addr); err != nil {
+		return err
+	}
+
+	// в epoll воркера сокет попадет только в Start, когда уже будут назначены обработчики
+	w.listenFd = listenFd
+	w.acceptAddr.setup()
+
+	return nil
+}
+
+// startWorkerListeners включает прием соединений воркерами в режиме ServerOptions.ReusePort
+func (srv *TCPServer) startWorkerListeners() (err error) {
+	for i := range srv.workerPool.workers {
+		w := &srv.workerPool.workers[i]
+
+		// под w.mu, чтобы воркер гарантированно увидел обработчики, назначенные до Start
+		w.mu.Lock()
+		if w.listenFd != 0 { // 0 - воркер уже остановлен
+			err = w.epoll.addClient(w.listenFd, syscall.EPOLLIN|EPOLLET, false)
+		}
+		w.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Start блокирующе запускает обработку новых соединений.
+// В режиме ServerOptions.ReusePort соединения принимают сами воркеры, и Start просто ждет остановки.
+// После Close или Shutdown возвращает nil
 func (srv *TCPServer) Start() error {
+	srv.epollMu.Lock()
+	if srv.epollClosed {
+		// сервер уже закрыт
+		srv.epollMu.Unlock()
+		return nil
+	}
+	srv.started = true
+	srv.epollMu.Unlock()
+
+	defer srv.closeEpoll()
+
+	if !srv.options.ReusePort {
+	} else if err := srv.startWorkerListeners(); err != nil {
+		return err
+	}
+
+	var acceptRetryAt time.Time // прием приостановлен до этого момента из-за AcceptRate
+
 loop:
-	for !srv.closed {
-		_, errno := srv.epoll.Wait()
+	for !srv.isClosed() && !srv.isShuttingDown() {
+		timeout := srv.epoll.WaitTimeout
+		if !acceptRetryAt.IsZero() {
+			timeout = retryTimeout(timeout, acceptRetryAt, time.Now())
+		}
+
+		_, errno := srv.epoll.WaitFor(timeout)
 		if errno != 0 {
 			if errno == syscall.EINTR {
 				runtime.Gosched()
@@ -166,123 +642,333 @@ loop:
 			return errno
 		}
 
+		if srv.options.ReusePort {
+			// соединения принимают воркеры, а сюда приходят только пробуждения от Close и Shutdown
+			continue
+		}
+
+		acceptRetryAt = time.Time{}
+
 		for {
-			clientFd, errno := srv.accept()
+			// после приостановки из-за MaxConnections повторная попытка будет при любом пробуждении
+			clientFd, retry, errno := srv.acceptListener()
 			if errno != 0 {
 				if errno == syscall.EAGAIN {
-					// обработаны все новые коннекты
+					// обработаны все новые коннекты (или прием приостановлен)
+					if retry > 0 {
+						acceptRetryAt = time.Now().Add(retry)
+					}
+					continue loop
+				} else if srv.isClosed() || srv.isShuttingDown() {
+					// слушающий сокет уже закрыт
 					continue loop
 				}
 				// ToDo: log
 				continue
 			}
 
-			workerEpoll := srv.getWorkerEPoll()
-			if err := workerEpoll.AddClient(clientFd); err != nil {
-				_, _, _ = syscall.Syscall(syscall.SYS_CLOSE, uintptr(clientFd), 0, 0)
-			} else {
-				var conn TCPConn
-				conn.fd = clientFd
-				srv.clients[clientFd] = &conn
-			}
+			srv.acceptConn(clientFd, srv.getWorker(), &srv.acceptAddr)
 		}
 	}
 
 	return nil
 }
 
-func (srv *TCPServer) getWorkerEPoll() *EPoll {
+// acceptConn создает соединение для только что принятого clientFd (адрес клиента в addr) и передает его воркеру w
+func (srv *TCPServer) acceptConn(clientFd int, w *tcpWorker, addr *sockaddrBuf) {
+	// воркер назначаю сразу, чтобы Close из других горутин работал еще до регистрации соединения
+	conn := srv.newConn(clientFd, w)
+	conn.accepted = true
+	if !srv.admitPeer(conn, addr) {
+		srv.releaseConn()
+		return
+	}
+	conn.remoteAddr, conn.localAddr = addr.netAddr(), srv.localAddr
+	if srv.family == syscall.AF_UNIX {
+		srv.setupUnixConn(conn)
+	}
+
+	if srv.options.ProxyProtocol != ProxyProtocolOff {
+		// OnClientConnect (или TLS handshake) - после получения заголовка, см. readProxyHeader
+		conn.preConnect, conn.proxyPending = true, true
+		srv.registerConn(conn, w)
+		return
+	} else if srv.options.TLSConfig != nil {
+		conn.preConnect = true
+		conn.setupTLS(srv.options.TLSConfig, srv.tlsHandshakeTimeout(), time.Now())
+		// читать из сокета соединение начнет вместе с handshake (см. beginTLS)
+		conn.readPaused = true
+		if srv.registerConn(conn, w) {
+			w.postFunc(func() {
+				w.beginTLS(conn)
+			})
+		}
+		return
+	}
+
+	if !srv.cnEvent(conn) {
+		conn.CloseAfterFlush()
+	}
+
+	mode, reason := conn.closeRequest()
+	if (mode == closeModeAbort) || ((mode == closeModeFlush) && (conn.WrBuf.Len() == 0)) {
+		// нет смысла передавать соединение воркеру
+		srv.closeConn(conn, reason)
+		return
+	}
+
+	srv.registerConn(conn, w)
+}
+
+// registerConn передает принятое соединение воркеру w, а если тот уже остановлен, то закрывает его
+func (srv *TCPServer) registerConn(conn *TCPConn, w *tcpWorker) bool {
+	if !w.register(conn) {
+		srv.closeConn(conn, CloseReasonServer)
+		return false
+	}
+	return true
+}
+
+// newConn создает соединение с настройками сервера по умолчанию
+func (srv *TCPServer) newConn(fd int, w *tcpWorker) *TCPConn {
+	conn := &TCPConn{
+		id:     atomic.AddUint64(&srv.lastConnID, 1),
+		fd:     fd,
+		worker: w,
+
+		idleTimeout:  srv.options.IdleTimeout,
+		readTimeout:  srv.options.ReadTimeout,
+		writeTimeout: srv.options.WriteTimeout,
+	}
+	conn.SetReadWatermarks(srv.options.ReadHighWater, srv.options.ReadLowWater)
+	conn.SetWriteBufferLimit(srv.options.WriteBufferLimit, srv.options.WriteLowWater)
+
+	return conn
+}
+
+func (srv *TCPServer) getWorker() *tcpWorker {
 	pool := &srv.workerPool
-	idx := pool.nextWorkerIdx
-	pool.nextWorkerIdx = (pool.nextWorkerIdx + 1) % len(pool.fds)
+	idx := (atomic.AddUint32(&pool.nextWorkerIdx, 1) - 1) % uint32(len(pool.workers))
 
-	return &pool.epolls[idx]
+	return &pool.workers[idx]
 }
 
-func (srv *TCPServer) startWorkerLoop(epoll *EPoll) error {
-	var (
-		readBuf    = make([]byte, 32*1024)
-		readBufPtr = uintptr(unsafe.Pointer(&readBuf[0]))
-		readBufLen = uintptr(len(readBuf))
-	)
+// readEvent вызывает обработчик чтения: собственный обработчик соединения, если он задан, иначе сервера
+func (srv *TCPServer) readEvent(conn *TCPConn) bool {
+	if conn.rdEvent != nil {
+		return conn.rdEvent(conn)
+	}
+	return srv.rdEvent(conn)
+}
 
-	for {
-		nEvents, errno := epoll.Wait()
-		if errno != 0 {
-			if errno == syscall.EINTR {
-				runtime.Gosched()
-				continue
-			}
-			return errno
-		} else if nEvents == 0 {
-			runtime.Gosched()
-			continue
-		}
+// eofEvent вызывает обработчик FIN от клиента аналогично readEvent
+func (srv *TCPServer) eofEvent(conn *TCPConn) bool {
+	if conn.efEvent != nil {
+		return conn.efEvent(conn)
+	}
+	return srv.efEvent(conn)
+}
+
+// writeEvent вызывает обработчик полной отправки WrBuf аналогично readEvent
+func (srv *TCPServer) writeEvent(conn *TCPConn) bool {
+	if conn.wrEvent != nil {
+		return conn.wrEvent(conn)
+	}
+	return srv.wrEvent(conn)
+}
 
-		for ev := 0; ev < nEvents; ev++ {
-			clientFd := int(epoll.events[ev].Fd)
-			eventsMask := epoll.events[ev].Events
+// writeLowWaterEvent вызывает обработчик опускания WrBuf до нижнего порога аналогично readEvent
+func (srv *TCPServer) writeLowWaterEvent(conn *TCPConn) bool {
+	if conn.wlEvent != nil {
+		return conn.wlEvent(conn)
+	}
+	return srv.wlEvent(conn)
+}
 
-			if (eventsMask & syscall.EPOLLIN) != 0 {
-				r1, _, errno := syscall.Syscall(syscall.SYS_READ, uintptr(clientFd), readBufPtr, readBufLen)
-				nbytes := int(r1)
+// closeConn закрывает сокет соединения, которое уже удалено из воркера (или еще не было в него добавлено)
+func (srv *TCPServer) closeConn(conn *TCPConn, reason CloseReason) {
+	if conn.dial != nil {
+		// исходящее соединение так и не установилось, так что обработчики соединения о нем не знают
+		srv.failDial(conn)
+		return
+	}
 
-				if errno != 0 {
-					if errno != syscall.EAGAIN { // если ошибка не про "обработаны все новые данные"
-						// syscall.EBADF, syscall.ECONNRESET, ...
-						srv.closeClient(epoll, clientFd)
-					}
-				} else if nbytes > 0 {
-					if conn, ok := srv.clients[clientFd]; ok {
-						_, _ = conn.RdBuf.Write(readBuf[:nbytes])
-						srv.rdEvent(conn)
-					}
-				} else {
-					// соединение закрылось
-					srv.closeClient(epoll, clientFd)
-				}
-				//} else if (eventsMask & syscall.EPOLLOUT) != 0 {
-				// можно записывать (если не получилось сразу весь ответ выслать)
-				// }
-			} else if (eventsMask & (syscall.EPOLLERR | syscall.EPOLLHUP)) != 0 {
-				srv.closeClient(epoll, clientFd)
-			}
+	if conn.tls != nil {
+		conn.tls.close()
+	}
+
+	if conn.preConnect {
+		// OnClientConnect так и не был вызван, и обработчики соединения о нем не знают
+	} else if conn.clEvent != nil {
+		conn.clEvent(conn, reason)
+	} else {
+		srv.clEvent(conn, reason)
+	}
+
+	conn.Context = nil
+	conn.RdBuf.Clean()
+	conn.WrBuf.Clean()
+
+	conn.closeFd()
+
+	if conn.peerCounted {
+		srv.peers.release(conn.peerKey)
+	}
+	if conn.accepted {
+		srv.releaseConn()
+	}
+}
+
+// Close немедленно останавливает сервер.
+// Воркеры закрывают свои соединения (с CloseReasonServer) без отправки WrBuf и epoll асинхронно,
+// при следующем пробуждении
+func (srv *TCPServer) Close() {
+	if !atomic.CompareAndSwapInt32(&srv.closed, 0, 1) {
+		return
+	}
+
+	srv.closeListener()
+	srv.wakeupAll()
+
+	srv.epollMu.Lock()
+	started := srv.started
+	srv.epollMu.Unlock()
+
+	if !started {
+		// иначе epoll закроет сам Start
+		srv.closeEpoll()
+	}
+}
+
+// Shutdown плавно останавливает сервер: прекращает прием новых соединений, дожидается отправки WrBuf
+// и закрывает все соединения (с CloseReasonServer), после чего ждет завершения горутин воркеров.
+// Если ctx истекает раньше, сервер останавливается через Close и возвращается ctx.Err()
+func (srv *TCPServer) Shutdown(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&srv.shutdown, 0, 1) {
+		srv.closeListener()
+		srv.wakeupAll()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.workersWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		srv.Close()
+		return nil
+	case <-ctx.Done():
+		srv.Close()
+		return ctx.Err()
+	}
+}
+
+// closeListener закрывает слушающий сокет (и удаляет файл unix сокета).
+// Повторные вызовы ничего не делают
+func (srv *TCPServer) closeListener() {
+	srv.listenerOnce.Do(func() {
+		// из srv.epoll сокет удалит само закрытие, а сам epoll к этому моменту уже может закрыть Start
+		srv.listenMu.Lock()
+		if srv.fd != 0 { // в режиме ReusePort слушающие сокеты закрывают воркеры
+			_, _, _ = syscall.Syscall(syscall.SYS_CLOSE, uintptr(srv.fd), 0, 0)
+			srv.fd = 0
 		}
+		srv.listenMu.Unlock()
+
+		if srv.unixPath != `` {
+			_ = os.Remove(srv.unixPath)
+		}
+	})
+}
+
+// closeEpoll закрывает epoll сервера. Повторные вызовы ничего не делают
+func (srv *TCPServer) closeEpoll() {
+	srv.epollMu.Lock()
+	defer srv.epollMu.Unlock()
+
+	if !srv.epollClosed {
+		srv.epollClosed = true
+		_ = srv.epoll.Close()
 	}
 }
 
-func (srv *TCPServer) closeClient(clientEpoll *EPoll, clientFd int) {
-	conn, ok := srv.clients[clientFd]
-	if ok {
-		conn.RdBuf.Clean()
-		conn.WrBuf.Clean()
-		delete(srv.clients, clientFd)
+// wakeupAll будит Start и все воркеры, чтобы они заметили остановку сервера
+func (srv *TCPServer) wakeupAll() {
+	_ = srv.epoll.Wakeup()
+
+	for i := range srv.workerPool.workers {
+		_ = srv.workerPool.epolls[i].Wakeup()
 	}
+}
 
-	_ = clientEpoll.DeleteFd(clientFd)
-	_, _, _ = syscall.Syscall(syscall.SYS_CLOSE, uintptr(clientFd), 0, 0)
+func (srv *TCPServer) isClosed() bool {
+	return atomic.LoadInt32(&srv.closed) != 0
 }
 
-// Close останавливает сервер
-func (srv *TCPServer) Close() {
-	srv.closed = true
-	srv.closeClient(&srv.epoll, srv.fd)
-	srv.fd = 0
+func (srv *TCPServer) isShuttingDown() bool {
+	return atomic.LoadInt32(&srv.shutdown) != 0
+}
+
+// acceptListener принимает соединение на общем слушающем сокете.
+// Выполняется под listenMu, т.к. иначе закрытый из другой горутины номер дескриптора может тут же занять
+// чужой сокет (например, слушающий сокет другого сервера), и accept заберет его соединение
+func (srv *TCPServer) acceptListener() (clientFd int, retry time.Duration, errno syscall.Errno) {
+	srv.listenMu.Lock()
+	defer srv.listenMu.Unlock()
 
-	for _, epoll := range srv.workerPool.epolls {
-		_, _, _ = syscall.Syscall(syscall.SYS_CLOSE, uintptr(epoll.fd), 0, 0)
+	if srv.fd == 0 {
+		return 0, 0, syscall.EBADF
 	}
-	srv.workerPool.epolls = srv.workerPool.epolls[:0]
+	return srv.acceptNext(srv.fd, &srv.acceptAddr)
 }
 
 func (srv *TCPServer) accept() (clientFd int, errno syscall.Errno) {
+	return acceptFd(srv.fd, &srv.acceptAddr)
+}
+
+// acceptFd принимает новое соединение на слушающем сокете listenFd, сохраняя адрес клиента в addr
+func acceptFd(listenFd int, addr *sockaddrBuf) (clientFd int, errno syscall.Errno) {
+	addr.Len = syscall.SizeofSockaddrAny // in/out параметр, так что восстанавливаю перед каждым вызовом
+
 	r1, _, errno := syscallWrappers.Syscall(
 		syscall.SYS_ACCEPT,
-		uintptr(srv.fd),
-		srv.acceptAddr.Ptr,
-		srv.acceptAddr.LenPtr,
+		uintptr(listenFd),
+		addr.Ptr,
+		addr.LenPtr,
 	)
 
 	clientFd = int(r1)
 	return clientFd, errno
 }
+
+// closeReasonByErrno определяет причину закрытия соединения по ошибке чтения/записи
+func closeReasonByErrno(err error) CloseReason {
+	if (err == syscall.ECONNRESET) || (err == syscall.EPIPE) {
+		return CloseReasonReset
+	}
+	return CloseReasonError
+}
+
+// String реализует fmt.Stringer
+func (reason CloseReason) String() string {
+	switch reason {
+	case CloseReasonEOF:
+		return `eof`
+	case CloseReasonReset:
+		return `reset`
+	case CloseReasonError:
+		return `error`
+	case CloseReasonServer:
+		return `server`
+	case CloseReasonHandler:
+		return `handler`
+	case CloseReasonTimeout:
+		return `timeout`
+	case CloseReasonProtocol:
+		return `protocol`
+	default:
+		return `unknown`
+	}
+}
@@ -2,10 +2,15 @@ package gonetz
 
 import (
 	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -23,6 +28,47 @@ func getSocketPort(fd int) int {
 	}
 }
 
+// newTestServer создает сервер с настройками opts (по умолчанию на 127.0.0.1) и возвращает его
+// вместе с адресом для подключения клиентов
+func newTestServer(t *testing.T, opts ServerOptions) (srv *TCPServer, addr string) {
+	if opts.Host == `` {
+		opts.Host = `127.0.0.1`
+	}
+
+	srv, err := NewServerWithOptions(opts)
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	} else if srv.Addr() == nil {
+		srv.Close()
+		t.Fatalf(`Cannot determine test server address`)
+	}
+
+	return srv, srv.Addr().String()
+}
+
+// startTestServer запускает srv.Start в отдельной горутине и возвращает функцию остановки сервера
+func startTestServer(t *testing.T, srv *TCPServer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := srv.Start(); err != nil {
+			t.Errorf(`Could not Start: %s`, err)
+		}
+	}()
+
+	return func() {
+		stopTestServer(srv)
+		<-done
+	}
+}
+
+// stopTestServer останавливает сервер и дожидается завершения горутин воркеров, чтобы они не пересекались
+// со следующими тестами (в том числе с подменой syscallWrappers)
+func stopTestServer(srv *TCPServer) {
+	srv.Close()
+	srv.workersWg.Wait()
+}
+
 func Test_TCPServer_setupAcceptAddr(t *testing.T) {
 	var srv TCPServer
 
@@ -98,7 +144,6 @@ func Test_TCPServer_newListenerIPv4_2(t *testing.T) {
 
 func Test_TCPServer_setupServerWorkers_1(t *testing.T) {
 	var srv TCPServer
-	//defer srv.Close()
 
 	if err := srv.setupServerWorkers(0); err == nil {
 		t.Errorf(`setupServerWorkers succeeded with 0 pool size`)
@@ -120,6 +165,11 @@ func Test_TCPServer_setupServerWorkers_1(t *testing.T) {
 		t.Errorf(`setupServerWorkers failed: %s`, err)
 		return
 	}
+	defer func() {
+		// у srv нет собственного epoll (Close закрыл бы fd 0), так что только останавливаю воркеры
+		atomic.StoreInt32(&srv.closed, 1)
+		srv.workersWg.Wait()
+	}()
 
 	if l := len(srv.workerPool.epolls); l != poolSize {
 		t.Errorf(`pool size after setupServerWorkers is wrong: expect %d got %d`, poolSize, l)
@@ -145,8 +195,8 @@ func Test_TCPServer_setupServerWorkers_1(t *testing.T) {
 		}
 	}
 
-	for _, epoll := range srv.workerPool.epolls {
-		if epoll.fd == 0 {
+	for i := range srv.workerPool.epolls {
+		if srv.workerPool.epolls[i].fd == 0 {
 			t.Errorf(`worker epoll is not initialized`)
 			return
 		}
@@ -224,7 +274,7 @@ func Test_TCPServer_NewServer_3(t *testing.T) {
 		t.Errorf(`NewServer failed: %s`, err)
 		return
 	}
-	//defer srv.Close()
+	defer stopTestServer(srv)
 
 	port := getSocketPort(srv.fd)
 	if port == 0 {
@@ -246,6 +296,25 @@ func Test_TCPServer_NewServer_4(t *testing.T) {
 	}
 }
 
+// trapEpollWait подменяет syscallWrappers.Syscall6: перед epoll_wait на epoll с номером *epfd вызывается check,
+// и ненулевой errno возвращается вместо настоящего вызова. Остальные вызовы (в т.ч. воркеров) не меняются.
+// Подменять нужно до NewServer, а восстанавливать после stopTestServer: горутины воркеров вызывают Syscall6 постоянно
+func trapEpollWait(check func() syscall.Errno) (epfd *int32) {
+	epfd = new(int32)
+	*epfd = -1
+
+	syscallWrappers.Syscall6 = func(trap, a1, a2, a3, a4, a5, a6 uintptr) (r1, r2 uintptr, err syscall.Errno) {
+		if (trap == syscall.SYS_EPOLL_WAIT) && (int32(a1) == atomic.LoadInt32(epfd)) {
+			if errno := check(); errno != 0 {
+				return 0, 0, errno
+			}
+		}
+		return defaultSyscallWrappers.Syscall6(trap, a1, a2, a3, a4, a5, a6)
+	}
+
+	return epfd
+}
+
 func Test_TCPServer_Start_1(t *testing.T) {
 	var bakDefaultEPollWaitTimeout = DefaultEPollWaitTimeout
 	DefaultEPollWaitTimeout = 10
@@ -253,9 +322,13 @@ func Test_TCPServer_Start_1(t *testing.T) {
 		DefaultEPollWaitTimeout = bakDefaultEPollWaitTimeout
 	}()
 
-	syscallWrappers.setWrongSyscall6(
-		checkFuncSyscallTrapSkipN(syscall.SYS_EPOLL_WAIT, 1, nil),
-	)
+	call := 0
+	epfd := trapEpollWait(func() syscall.Errno {
+		if call++; call <= 1 {
+			return syscall.EINVAL
+		}
+		return 0
+	})
 	defer syscallWrappers.setRealSyscall6()
 
 	srv, err := NewServer(`127.0.0.1`, 0)
@@ -263,7 +336,8 @@ func Test_TCPServer_Start_1(t *testing.T) {
 		t.Errorf(`NewServer failed: %s`, err)
 		return
 	}
-	//defer srv.Close()
+	defer stopTestServer(srv)
+	atomic.StoreInt32(epfd, int32(srv.epoll.fd))
 
 	timeout := time.Duration(DefaultEPollWaitTimeout) * time.Millisecond
 	timeLimiter := time.After(timeout * 2) // x2 запас на время реакции
@@ -275,7 +349,10 @@ func Test_TCPServer_Start_1(t *testing.T) {
 
 	select {
 	case <-timeLimiter:
-		success <- false
+		t.Errorf(`Server start with wrong syscall.Syscall6 did not fail in time`)
+		// Start должен завершиться до восстановления Syscall6
+		stopTestServer(srv)
+		<-success
 	case succ := <-success:
 		if succ {
 			t.Errorf(`Successful server start with wrong syscall.Syscall6`)
@@ -284,42 +361,34 @@ func Test_TCPServer_Start_1(t *testing.T) {
 }
 
 func Test_TCPServer_Start_2(t *testing.T) {
-	srv, err := NewServer(`127.0.0.1`, 0)
-	if err != nil {
-		t.Errorf(`NewServer failed: %s`, err)
-		return
-	}
-	//defer srv.Close()
-
 	call := 0
-	syscallWrappers.Syscall6 = func(trap, a1, a2, a3, a4, a5, a6 uintptr) (r1, r2 uintptr, err syscall.Errno) {
+	epfd := trapEpollWait(func() syscall.Errno {
 		if call++; call <= 1 {
-			return 0, 0, syscall.EINTR
+			return syscall.EINTR
 		}
-		return 0, 0, syscall.EINVAL
-	}
-	err = srv.Start()
-	syscallWrappers.setRealSyscall6()
-	if err == nil {
-		t.Errorf(`Successful Start with wrong Syscall6`)
-		return
-	}
-}
+		return syscall.EINVAL
+	})
+	defer syscallWrappers.setRealSyscall6()
 
-// Тест на TCPServer.Start где accept возвращает ошибку, отличную от EAGAIN
-func Test_TCPServer_Start_3(t *testing.T) {
 	srv, err := NewServer(`127.0.0.1`, 0)
 	if err != nil {
 		t.Errorf(`NewServer failed: %s`, err)
 		return
 	}
+	defer stopTestServer(srv)
+	atomic.StoreInt32(epfd, int32(srv.epoll.fd))
 
-	port := getSocketPort(srv.fd)
-	if port == 0 {
-		t.Errorf(`Cannot determine test socket port`)
-		return
+	if err := srv.Start(); err == nil {
+		t.Errorf(`Successful Start with wrong Syscall6`)
+	} else if call != 2 {
+		t.Errorf(`Start did not retry epoll_wait after EINTR: %d calls`, call)
 	}
+}
 
+// Тест на TCPServer.Start где accept возвращает ошибку, отличную от EAGAIN
+func Test_TCPServer_Start_3(t *testing.T) {
+	// accept вызывает только горутина Start, а остальные вызовы (в т.ч. воркеров) идут в настоящий Syscall.
+	// Подмена до NewServer и восстановление после остановки сервера, т.к. воркеры вызывают Syscall постоянно
 	call := 0
 	syscallWrappers.Syscall = func(trap, a1, a2, a3 uintptr) (r1, r2 uintptr, err syscall.Errno) {
 		if trap != syscall.SYS_ACCEPT {
@@ -333,11 +402,21 @@ func Test_TCPServer_Start_3(t *testing.T) {
 	}
 	defer syscallWrappers.setRealSyscall()
 
-	go func() {
-		if err := srv.Start(); err != nil {
-			t.Errorf(`Could not Start: %s`, err)
-		}
-	}()
+	srv, err := NewServer(`127.0.0.1`, 0)
+	if err != nil {
+		t.Errorf(`NewServer failed: %s`, err)
+		return
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		srv.Close()
+		t.Errorf(`Cannot determine test socket port`)
+		return
+	}
+
+	stop := startTestServer(t, srv)
+	defer stop()
 
 	time.Sleep(100 * time.Millisecond) // Даю srv.Start() пройти хотя бы одну итерацию
 
@@ -354,7 +433,7 @@ func Test_TCPServer_Start_4(t *testing.T) {
 	if err != nil {
 		t.Fatalf(`NewServer failed: %s`, err)
 	}
-	//defer srv.Close()
+	defer stopTestServer(srv)
 
 	port := getSocketPort(srv.fd)
 	if port == 0 {
@@ -380,7 +459,6 @@ func Test_TCPServer_Start_4(t *testing.T) {
 	}
 
 	time.Sleep(1 * time.Second)
-	srv.Close()
 }
 
 // Тест на TCPServer.startWorkerLoop syscall.EPOLLIN => (errno != syscall.EAGAIN)
@@ -389,6 +467,7 @@ func Test_TCPServer_Start_5(t *testing.T) {
 	if err != nil {
 		t.Fatalf(`NewServer failed: %s`, err)
 	}
+	defer stopTestServer(srv)
 
 	port := getSocketPort(srv.fd)
 	if port == 0 {
@@ -420,7 +499,7 @@ func Test_TCPServer_Start_6(t *testing.T) {
 		t.Errorf(`NewServer failed: %s`, err)
 		return
 	}
-	//defer srv.Close()
+	defer stopTestServer(srv)
 
 	port := getSocketPort(srv.fd)
 	if port == 0 {
@@ -496,8 +575,1829 @@ func Test_TCPServer_startWorkerLoop(t *testing.T) {
 	if err := srv.setupServerWorkers(1); err != nil {
 		t.Errorf(`setupServerWorkers was failed: %s`, err)
 	}
+	// горутина, запущенная setupServerWorkers, с таким Syscall6 тоже сразу завершается с ошибкой.
+	// Дожидаюсь ее, чтобы цикл того же воркера не выполнялся в двух горутинах и не пересекся с setRealSyscall6
+	srv.workersWg.Wait()
 
-	if err := srv.startWorkerLoop(&srv.workerPool.epolls[0]); err == nil {
+	if err := srv.startWorkerLoop(&srv.workerPool.workers[0]); err == nil {
 		t.Errorf(`startWorkerLoop with wrong syscall.Syscall6(syscall.SYS_EPOLL_WAIT) was successful`)
 	}
 }
+
+// Тест на отправку ответа через TCPConn.Write с дозаписью по EPOLLOUT
+func Test_TCPServer_Start_7(t *testing.T) {
+	srv, err := NewServer(`127.0.0.1`, 0)
+	if err != nil {
+		t.Fatalf(`NewServer failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	var testData = make([]byte, 1024*1024)
+	rand.Read(testData)
+
+	wrEvents := make(chan bool, 1)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		// маленький буфер сокета гарантирует, что ответ не уйдет одним write
+		if err := syscall.SetsockoptInt(conn.fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, 4096); err != nil {
+			t.Errorf(`Could not set SO_SNDBUF: %s`, err)
+		}
+		return true
+	})
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		conn.RdBuf.Discard(conn.RdBuf.Len())
+		if _, err := conn.Write(testData); err != nil {
+			t.Errorf(`Could not write client data: %s`, err)
+		}
+		return true
+	})
+
+	srv.OnClientWrite(func(conn *TCPConn) bool {
+		select {
+		case wrEvents <- true:
+		default:
+		}
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write([]byte(`get`)); err != nil {
+		t.Fatalf(`Could not write to client: %s`, err)
+	}
+
+	time.Sleep(100 * time.Millisecond) // даю серверу упереться в заполненный буфер сокета
+
+	readed := make([]byte, len(testData))
+	if _, err := io.ReadFull(client, readed); err != nil {
+		t.Fatalf(`Could not read response: %s`, err)
+	} else if !bytes.Equal(readed, testData) {
+		t.Fatalf(`Response data differs from sended`)
+	}
+
+	select {
+	case <-wrEvents:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientWrite was not called`)
+	}
+}
+
+// Тест на вычитывание сокета до EAGAIN: данных больше, чем влезает в буфер чтения воркера,
+// и все они пришли еще до регистрации клиента в epoll (т.е. будет ровно одно событие EPOLLIN)
+func Test_TCPServer_Start_8(t *testing.T) {
+	srv, err := NewServer(`127.0.0.1`, 0)
+	if err != nil {
+		t.Fatalf(`NewServer failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	var testData = make([]byte, 3*32*1024+1)
+	rand.Read(testData)
+
+	var (
+		readedMu sync.Mutex
+		readed   bytes.Buffer
+		done     = make(chan bool, 1)
+	)
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		readedMu.Lock()
+		defer readedMu.Unlock()
+
+		if _, err := readed.ReadFrom(conn); err != nil {
+			t.Errorf(`Could not read client data: %s`, err)
+		}
+		if readed.Len() >= len(testData) {
+			done <- true
+		}
+		return true
+	})
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+
+	if _, err := client.Write(testData); err != nil {
+		t.Fatalf(`Could not write to client: %s`, err)
+	}
+
+	time.Sleep(100 * time.Millisecond) // даю данным дойти до серверного сокета
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		readedMu.Lock()
+		got := readed.Len()
+		readedMu.Unlock()
+		t.Fatalf(`Not all data was readed. Expect:%d got:%d`, len(testData), got)
+	}
+
+	readedMu.Lock()
+	defer readedMu.Unlock()
+	if !bytes.Equal(readed.Bytes(), testData) {
+		t.Fatalf(`Readed data differs from sended`)
+	}
+}
+
+// Тест на OnClientConnect + OnClientClose
+func Test_TCPServer_Start_9(t *testing.T) {
+	srv, err := NewServer(`127.0.0.1`, 0)
+	if err != nil {
+		t.Fatalf(`NewServer failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	greeting := []byte(`hello`)
+	closeReasons := make(chan CloseReason, 1)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		if _, err := conn.Write(greeting); err != nil {
+			t.Errorf(`Could not write greeting: %s`, err)
+		}
+		return true
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		closeReasons <- reason
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	_ = client.SetDeadline(time.Now().Add(1 * time.Second))
+
+	readed := make([]byte, len(greeting))
+	if _, err := io.ReadFull(client, readed); err != nil {
+		t.Fatalf(`Could not read greeting: %s`, err)
+	} else if !bytes.Equal(readed, greeting) {
+		t.Fatalf(`Greeting differs. Expect: %q got: %q`, greeting, readed)
+	}
+
+	_ = client.Close()
+
+	select {
+	case reason := <-closeReasons:
+		if reason != CloseReasonEOF {
+			t.Fatalf(`Wrong close reason. Expect: %s got: %s`, CloseReasonEOF, reason)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientClose was not called`)
+	}
+}
+
+// Тест на отказ в подключении из OnClientConnect
+func Test_TCPServer_Start_10(t *testing.T) {
+	srv, err := NewServer(`127.0.0.1`, 0)
+	if err != nil {
+		t.Fatalf(`NewServer failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	closeReasons := make(chan CloseReason, 1)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		return false
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		closeReasons <- reason
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(1 * time.Second))
+
+	if n, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatalf(`Unexpected read from rejected connection: %d bytes`, n)
+	}
+
+	select {
+	case reason := <-closeReasons:
+		if reason != CloseReasonHandler {
+			t.Fatalf(`Wrong close reason. Expect: %s got: %s`, CloseReasonHandler, reason)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientClose was not called`)
+	}
+}
+
+func Test_TCPServer_CloseReason_String(t *testing.T) {
+	reasons := []CloseReason{
+		CloseReasonEOF, CloseReasonReset, CloseReasonError, CloseReasonServer, CloseReasonHandler,
+	}
+
+	seen := map[string]bool{}
+	for _, reason := range reasons {
+		str := reason.String()
+		if (str == ``) || (str == `unknown`) || seen[str] {
+			t.Fatalf(`Wrong string for close reason %d: %q`, int(reason), str)
+		}
+		seen[str] = true
+	}
+
+	if got, exp := CloseReason(-1).String(), `unknown`; got != exp {
+		t.Fatalf(`Wrong string for unknown close reason. Expect: %q got: %q`, exp, got)
+	}
+}
+
+// Тест на закрытие соединения после отправки ответа (false из OnClientRead)
+func Test_TCPServer_Start_11(t *testing.T) {
+	srv, err := NewServer(`127.0.0.1`, 0)
+	if err != nil {
+		t.Fatalf(`NewServer failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	var testData = make([]byte, 4*1024*1024) // чтобы отправка не уложилась в один write
+	rand.Read(testData)
+
+	closeReasons := make(chan CloseReason, 1)
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		conn.RdBuf.Discard(conn.RdBuf.Len())
+		if _, err := conn.Write(testData); err != nil {
+			t.Errorf(`Could not write client data: %s`, err)
+		}
+		return false
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		closeReasons <- reason
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write([]byte(`get`)); err != nil {
+		t.Fatalf(`Could not write to client: %s`, err)
+	}
+
+	if readed, err := ioutil.ReadAll(client); err != nil {
+		t.Fatalf(`Could not read response: %s`, err)
+	} else if !bytes.Equal(readed, testData) {
+		t.Fatalf(`Response data differs from sended. Expect len:%d got len:%d`, len(testData), len(readed))
+	}
+
+	select {
+	case reason := <-closeReasons:
+		if reason != CloseReasonHandler {
+			t.Fatalf(`Wrong close reason. Expect: %s got: %s`, CloseReasonHandler, reason)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientClose was not called`)
+	}
+}
+
+// Тест на немедленное закрытие соединения через TCPConn.Close
+func Test_TCPServer_Start_12(t *testing.T) {
+	srv, err := NewServer(`127.0.0.1`, 0)
+	if err != nil {
+		t.Fatalf(`NewServer failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		_, _ = conn.Write([]byte(`dropped`))
+		_ = conn.Close()
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(1 * time.Second))
+
+	if _, err := client.Write([]byte(`get`)); err != nil {
+		t.Fatalf(`Could not write to client: %s`, err)
+	}
+
+	buf := make([]byte, 1024)
+	for {
+		if _, err = client.Read(buf); err != nil {
+			break
+		}
+	}
+
+	if opErr, ok := err.(*net.OpError); !ok || opErr.Timeout() {
+		t.Fatalf(`Expected connection reset, got: %v`, err)
+	}
+}
+
+// Тест на закрытие соединения из сторонней горутины
+func Test_TCPServer_Start_13(t *testing.T) {
+	srv, err := NewServer(`127.0.0.1`, 0)
+	if err != nil {
+		t.Fatalf(`NewServer failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	conns := make(chan *TCPConn, 1)
+	closeReasons := make(chan CloseReason, 1)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		conns <- conn
+		return true
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		closeReasons <- reason
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(1 * time.Second))
+
+	select {
+	case conn := <-conns:
+		conn.CloseAfterFlush()
+		conn.CloseAfterFlush() // повторный вызов ничего не должен ломать
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientConnect was not called`)
+	}
+
+	if n, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf(`Expected EOF from closed connection, got: %d bytes, %v`, n, err)
+	}
+
+	select {
+	case reason := <-closeReasons:
+		if reason != CloseReasonHandler {
+			t.Fatalf(`Wrong close reason. Expect: %s got: %s`, CloseReasonHandler, reason)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientClose was not called`)
+	}
+}
+
+func Test_TCPServer_NewServerWithOptions_1(t *testing.T) {
+	srv, err := NewServerWithOptions(ServerOptions{
+		Host:           `127.0.0.1`,
+		Workers:        3,
+		ReadBufferSize: 1024,
+		ListenBacklog:  16,
+		EPollEvents:    64,
+		WaitTimeout:    5,
+	})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+	defer stopTestServer(srv)
+
+	if got, exp := len(srv.workerPool.workers), 3; got != exp {
+		t.Fatalf(`Wrong workers count. Expect %d got %d`, exp, got)
+	}
+
+	for i := range srv.workerPool.epolls {
+		epoll := &srv.workerPool.epolls[i]
+		if got, exp := epoll.eventsCap, 64; got != exp {
+			t.Fatalf(`Wrong worker epoll events cap. Expect %d got %d`, exp, got)
+		} else if got, exp := epoll.WaitTimeout, Millisecond(5); got != exp {
+			t.Fatalf(`Wrong worker epoll WaitTimeout. Expect %d got %d`, exp, got)
+		}
+	}
+
+	if got, exp := srv.epoll.WaitTimeout, Millisecond(5); got != exp {
+		t.Fatalf(`Wrong server epoll WaitTimeout. Expect %d got %d`, exp, got)
+	}
+
+	if got, exp := srv.readBufferSize(), 1024; got != exp {
+		t.Fatalf(`Wrong read buffer size. Expect %d got %d`, exp, got)
+	}
+}
+
+func Test_TCPServer_NewServerWithOptions_2(t *testing.T) {
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+	defer stopTestServer(srv)
+
+	if got, exp := len(srv.workerPool.workers), runtime.GOMAXPROCS(0); got != exp {
+		t.Fatalf(`Wrong default workers count. Expect %d got %d`, exp, got)
+	}
+
+	if got, exp := srv.readBufferSize(), defaultReadBufferSize; got != exp {
+		t.Fatalf(`Wrong default read buffer size. Expect %d got %d`, exp, got)
+	} else if got, exp := srv.listenBacklog(), maxEpollEvents; got != exp {
+		t.Fatalf(`Wrong default listen backlog. Expect %d got %d`, exp, got)
+	}
+}
+
+// Тест на обработку соединений несколькими воркерами
+func Test_TCPServer_Start_14(t *testing.T) {
+	const clients = 16
+
+	srv, err := NewServerWithOptions(ServerOptions{
+		Host:           `127.0.0.1`,
+		Workers:        4,
+		ReadBufferSize: 16, // заведомо меньше запроса
+	})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		buf := make([]byte, conn.RdBuf.Len())
+		n, _ := conn.Read(buf)
+		_, _ = conn.Write(buf[:n])
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+			if err != nil {
+				t.Errorf(`Could not dial to server: %s`, err)
+				return
+			}
+			defer client.Close()
+			_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+
+			req := bytes.Repeat([]byte{byte('a' + i)}, 1000)
+			if _, err := client.Write(req); err != nil {
+				t.Errorf(`Could not write to client: %s`, err)
+				return
+			}
+
+			resp := make([]byte, len(req))
+			if _, err := io.ReadFull(client, resp); err != nil {
+				t.Errorf(`Could not read response: %s`, err)
+			} else if !bytes.Equal(req, resp) {
+				t.Errorf(`Response differs from request`)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Тест на FIN, пришедший вместе с данными: короткое чтение не должно прерывать вычитывание сокета
+func Test_TCPServer_Start_15(t *testing.T) {
+	srv, err := NewServer(`127.0.0.1`, 0)
+	if err != nil {
+		t.Fatalf(`NewServer failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	var (
+		testData     = []byte(`hello`)
+		readed       = make(chan []byte, 1)
+		closeReasons = make(chan CloseReason, 1)
+	)
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		buf := make([]byte, conn.RdBuf.Len())
+		n, _ := conn.Read(buf)
+		readed <- buf[:n]
+		return true
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		closeReasons <- reason
+	})
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+
+	if _, err := client.Write(testData); err != nil {
+		t.Fatalf(`Could not write to client: %s`, err)
+	}
+	_ = client.Close()
+
+	time.Sleep(100 * time.Millisecond) // данные и FIN к моменту accept уже лежат в серверном сокете
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	select {
+	case data := <-readed:
+		if !bytes.Equal(data, testData) {
+			t.Fatalf(`Readed data differs. Expect: %q got: %q`, testData, data)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientRead was not called`)
+	}
+
+	select {
+	case reason := <-closeReasons:
+		if reason != CloseReasonEOF {
+			t.Fatalf(`Wrong close reason. Expect: %s got: %s`, CloseReasonEOF, reason)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientClose was not called`)
+	}
+}
+
+// Тест на клиента, закрывшего свою сторону соединения сразу после запроса: ответ, не влезший в буфер сокета,
+// должен быть дослан целиком, и только после этого соединение закрывается с CloseReasonEOF
+func Test_TCPServer_Start_16(t *testing.T) {
+	srv, err := NewServer(`127.0.0.1`, 0)
+	if err != nil {
+		t.Fatalf(`NewServer failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	var testData = make([]byte, 4*1024*1024)
+	rand.Read(testData)
+
+	closeReasons := make(chan CloseReason, 1)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		// маленький буфер сокета, чтобы к приходу FIN большая часть ответа еще лежала в WrBuf
+		if err := syscall.SetsockoptInt(conn.fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, 4096); err != nil {
+			t.Errorf(`Could not set SO_SNDBUF: %s`, err)
+		}
+		return true
+	})
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		conn.RdBuf.Discard(conn.RdBuf.Len())
+		if _, err := conn.Write(testData); err != nil {
+			t.Errorf(`Could not write client data: %s`, err)
+		}
+		return true
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		closeReasons <- reason
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write([]byte(`get`)); err != nil {
+		t.Fatalf(`Could not write to client: %s`, err)
+	} else if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf(`Could not close write side: %s`, err)
+	}
+
+	if readed, err := ioutil.ReadAll(client); err != nil {
+		t.Fatalf(`Could not read response: %s`, err)
+	} else if !bytes.Equal(readed, testData) {
+		t.Fatalf(`Response data differs from sended. Expect len:%d got len:%d`, len(testData), len(readed))
+	}
+
+	select {
+	case reason := <-closeReasons:
+		if reason != CloseReasonEOF {
+			t.Fatalf(`Wrong close reason. Expect: %s got: %s`, CloseReasonEOF, reason)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientClose was not called`)
+	}
+}
+
+// Тест на OnClientEOF: после FIN от клиента соединение остается открытым для записи, пока его не закроет обработчик
+func Test_TCPServer_Start_17(t *testing.T) {
+	srv, addr := newTestServer(t, ServerOptions{})
+
+	closeReasons := make(chan CloseReason, 1)
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		conn.RdBuf.Discard(conn.RdBuf.Len())
+		return true
+	})
+
+	srv.OnClientEOF(func(conn *TCPConn) bool {
+		// ответ отправляется уже после FIN и не из обработчика
+		time.AfterFunc(50*time.Millisecond, func() {
+			conn.Post(func() {
+				if _, err := conn.Write([]byte(`late`)); err != nil {
+					t.Errorf(`Could not write client data: %s`, err)
+				}
+				conn.CloseAfterFlush()
+			})
+		})
+		return true
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		closeReasons <- reason
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, addr, 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write([]byte(`get`)); err != nil {
+		t.Fatalf(`Could not write to client: %s`, err)
+	} else if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatalf(`Could not close write side: %s`, err)
+	}
+
+	if readed, err := ioutil.ReadAll(client); err != nil {
+		t.Fatalf(`Could not read response: %s`, err)
+	} else if string(readed) != `late` {
+		t.Fatalf(`Unexpected response: %q`, readed)
+	}
+
+	select {
+	case reason := <-closeReasons:
+		if reason != CloseReasonHandler {
+			t.Fatalf(`Wrong close reason. Expect: %s got: %s`, CloseReasonHandler, reason)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientClose was not called`)
+	}
+}
+
+// Тест на Write из Post после закрытия соединения: данные не должны попасть в новое соединение с тем же fd
+func Test_TCPServer_Start_18(t *testing.T) {
+	srv, addr := newTestServer(t, ServerOptions{Workers: 1})
+
+	conns := make(chan *TCPConn, 2)
+	closed := make(chan struct{}, 2)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		conns <- conn
+		return true
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		closed <- struct{}{}
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	first, err := net.DialTimeout(`tcp`, addr, 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	firstConn := <-conns
+	first.Close()
+
+	select {
+	case <-closed:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientClose was not called`)
+	}
+
+	second, err := net.DialTimeout(`tcp`, addr, 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer second.Close()
+	<-conns
+
+	writeErrs := make(chan error, 1)
+	firstConn.Post(func() {
+		_, err := firstConn.Write([]byte(`leaked`))
+		writeErrs <- err
+	})
+
+	if err := <-writeErrs; err != ErrConnClosed {
+		t.Fatalf(`Wrong Write error. Expect: %v got: %v`, ErrConnClosed, err)
+	}
+
+	_ = second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 16)
+	if n, err := second.Read(buf); n > 0 {
+		t.Fatalf(`Data from closed connection was sent to a new one: %q`, buf[:n])
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf(`Unexpected read error: %v`, err)
+	}
+}
+
+func skipWithoutIPv6(t *testing.T) {
+	if ln, err := net.Listen(`tcp6`, `[::1]:0`); err != nil {
+		t.Skipf(`IPv6 is not available: %s`, err)
+	} else {
+		_ = ln.Close()
+	}
+}
+
+func Test_TCPServer_newListenerIPv6(t *testing.T) {
+	skipWithoutIPv6(t)
+
+	var srv TCPServer
+
+	if err := srv.newListenerIPv6(`lol.kek`, 0); err != ErrWrongHost {
+		t.Fatalf(`newListenerIPv6 for wrong host returned wrong error: %v`, err)
+	}
+
+	if err := srv.newListenerIPv6(`127.0.0.1`, 0); err != ErrWrongHost {
+		t.Fatalf(`newListenerIPv6 for IPv4 host returned wrong error: %v`, err)
+	}
+
+	if err := srv.newListenerIPv6(`::1%no-such-iface`, 0); err != ErrWrongHost {
+		t.Fatalf(`newListenerIPv6 for wrong zone returned wrong error: %v`, err)
+	}
+
+	if err := srv.newListenerIPv4(`::1`, 0); err != ErrWrongHost {
+		t.Fatalf(`newListenerIPv4 for IPv6 host returned wrong error: %v`, err)
+	}
+
+	if err := srv.newListenerIPv6(``, 0); err != nil {
+		t.Fatalf(`newListenerIPv6 with empty host failed: %s`, err)
+	}
+
+	if err := srv.newListenerIPv6(`::1`, 0); err != nil {
+		t.Fatalf(`newListenerIPv6 with ::1 host failed: %s`, err)
+	}
+
+	if err := srv.newListener(`::1`, 0); err != nil {
+		t.Fatalf(`newListener with ::1 host failed: %s`, err)
+	} else if sa, err := syscall.Getsockname(srv.fd); err != nil {
+		t.Fatalf(`Getsockname failed: %s`, err)
+	} else if _, ok := sa.(*syscall.SockaddrInet6); !ok {
+		t.Fatalf(`newListener with ::1 host created not IPv6 socket: %T`, sa)
+	}
+
+	syscallWrappers.setWrongSetsockoptInt(func(data interface{}) bool {
+		if ints, ok := data.([]int); ok && len(ints) > 3 {
+			return ints[2] != syscall.IPV6_V6ONLY
+		}
+		return true
+	})
+	err := srv.newListenerIPv6(`::1`, 0)
+	syscallWrappers.setRealSetsockoptInt()
+	if err == nil {
+		t.Fatalf(`newListenerIPv6 with wrong IPV6_V6ONLY setsockopt was successful`)
+	}
+}
+
+// Тест на dual-stack сокет: IPv4 и IPv6 клиенты на одном слушающем сокете
+func Test_TCPServer_Start_IPv6_1(t *testing.T) {
+	skipWithoutIPv6(t)
+
+	srv, err := NewServerWithOptions(ServerOptions{Host: `::`, Workers: 1})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		buf := make([]byte, conn.RdBuf.Len())
+		n, _ := conn.Read(buf)
+		_, _ = conn.Write(buf[:n])
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	for _, addr := range []string{`127.0.0.1`, `[::1]`} {
+		client, err := net.DialTimeout(`tcp`, addr+`:`+strconv.Itoa(port), 1*time.Second)
+		if err != nil {
+			t.Fatalf(`Could not dial to server via %s: %s`, addr, err)
+		}
+		_ = client.SetDeadline(time.Now().Add(1 * time.Second))
+
+		req := []byte(`ping`)
+		resp := make([]byte, len(req))
+		if _, err := client.Write(req); err != nil {
+			t.Fatalf(`Could not write via %s: %s`, addr, err)
+		} else if _, err := io.ReadFull(client, resp); err != nil {
+			t.Fatalf(`Could not read via %s: %s`, addr, err)
+		} else if !bytes.Equal(req, resp) {
+			t.Fatalf(`Response via %s differs from request`, addr)
+		}
+		_ = client.Close()
+	}
+}
+
+// Тест на раздельные IPv4 и IPv6 сокеты на одном порту
+func Test_TCPServer_Start_IPv6_2(t *testing.T) {
+	skipWithoutIPv6(t)
+
+	var (
+		srv6, srv4 *TCPServer
+		port       int
+		err        error
+	)
+
+	// выбранный ядром порт на IPv4 может быть занят, например, закрытым соединением в TIME_WAIT
+	for try := 0; (srv4 == nil) && (try < 10); try++ {
+		if srv6 != nil {
+			stopTestServer(srv6)
+		}
+
+		srv6, err = NewServerWithOptions(ServerOptions{Host: `::`, Workers: 1, IPv6Only: true})
+		if err != nil {
+			t.Fatalf(`NewServerWithOptions (IPv6) failed: %s`, err)
+		}
+
+		port = getSocketPort(srv6.fd)
+		if port == 0 {
+			t.Fatalf(`Cannot determine test socket port`)
+		}
+
+		srv4, err = NewServerWithOptions(ServerOptions{Host: `0.0.0.0`, Port: uint(port), Workers: 1})
+		if (err != nil) && (err != syscall.EADDRINUSE) {
+			break
+		}
+	}
+	defer stopTestServer(srv6)
+
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions (IPv4) on the same port failed: %s`, err)
+	}
+	defer stopTestServer(srv4)
+
+	// без IPV6_V6ONLY второй сокет на том же порту не создать
+	srvBoth, err := NewServerWithOptions(ServerOptions{Host: `::`, Port: uint(port), Workers: 1})
+	if err == nil {
+		srvBoth.Close()
+		t.Fatalf(`NewServerWithOptions (dual-stack) on busy port was successful`)
+	}
+}
+
+func Test_TCPServer_Start_ReusePort(t *testing.T) {
+	const (
+		workers = 4
+		clients = 32
+	)
+
+	if _, err := NewServerWithOptions(ServerOptions{Network: `unix`, Host: `/tmp/gonetz.sock`, ReusePort: true}); err != ErrWrongNetwork {
+		t.Fatalf(`ReusePort for unix socket returned wrong error: %v`, err)
+	}
+
+	srv, err := NewServerWithOptions(ServerOptions{
+		Host:      `127.0.0.1`,
+		Workers:   workers,
+		ReusePort: true,
+	})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	if srv.fd != 0 {
+		t.Fatalf(`server listener was not passed to worker`)
+	}
+
+	port := getSocketPort(srv.workerPool.workers[0].listenFd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	for i := range srv.workerPool.workers {
+		w := &srv.workerPool.workers[i]
+		if w.listenFd == 0 {
+			t.Fatalf(`worker %d has no listener`, i)
+		} else if got := getSocketPort(w.listenFd); got != port {
+			t.Fatalf(`worker %d listens on wrong port: expect %d got %d`, i, port, got)
+		}
+	}
+
+	var (
+		mu          sync.Mutex
+		connWorkers = map[*tcpWorker]int{}
+	)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		mu.Lock()
+		connWorkers[conn.worker]++
+		mu.Unlock()
+		return true
+	})
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		buf := make([]byte, conn.RdBuf.Len())
+		n, _ := conn.Read(buf)
+		_, _ = conn.Write(buf[:n])
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+			if err != nil {
+				t.Errorf(`Could not dial to server: %s`, err)
+				return
+			}
+			defer client.Close()
+			_ = client.SetDeadline(time.Now().Add(2 * time.Second))
+
+			req := bytes.Repeat([]byte{byte('a' + i%26)}, 100)
+			if _, err := client.Write(req); err != nil {
+				t.Errorf(`Could not write to client: %s`, err)
+				return
+			}
+
+			resp := make([]byte, len(req))
+			if _, err := io.ReadFull(client, resp); err != nil {
+				t.Errorf(`Could not read response: %s`, err)
+			} else if !bytes.Equal(req, resp) {
+				t.Errorf(`Response differs from request`)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	total := 0
+	for _, cnt := range connWorkers {
+		total += cnt
+	}
+	if total != clients {
+		t.Fatalf(`connections count mismatch: expect %d got %d`, clients, total)
+	}
+	// распределение делает ядро по хешу адресов, так что равномерности не жду, но одним воркером дело обойтись не должно
+	if len(connWorkers) < 2 {
+		t.Fatalf(`all connections were accepted by single worker`)
+	}
+}
+
+// Тест на плавную остановку: отложенные данные дописываются клиенту, после чего соединение закрывается
+func Test_TCPServer_Shutdown_1(t *testing.T) {
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 2})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	var testData = make([]byte, 1024*1024)
+	rand.Read(testData)
+
+	connected := make(chan bool, 1)
+	reasons := make(chan CloseReason, 1)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		// маленький буфер сокета гарантирует, что к началу Shutdown в WrBuf еще будут данные
+		if err := syscall.SetsockoptInt(conn.fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, 4096); err != nil {
+			t.Errorf(`Could not set SO_SNDBUF: %s`, err)
+		}
+		_, _ = conn.Write(testData)
+		connected <- true
+		return true
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		reasons <- reason
+	})
+
+	started := make(chan error, 1)
+	go func() {
+		started <- srv.Start()
+	}()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	select {
+	case <-connected:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientConnect was not called`)
+	}
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+
+	time.Sleep(50 * time.Millisecond) // Shutdown не должен завершиться, пока клиент не вычитал ответ
+
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf(`Shutdown returned before data was flushed: %v`, err)
+	default:
+	}
+
+	if readed, err := ioutil.ReadAll(client); err != nil {
+		t.Fatalf(`Could not read response: %s`, err)
+	} else if !bytes.Equal(readed, testData) {
+		t.Fatalf(`Response data differs from sended: got %d bytes`, len(readed))
+	}
+
+	if err := <-shutdownErr; err != nil {
+		t.Fatalf(`Shutdown failed: %s`, err)
+	}
+
+	if got, exp := <-reasons, CloseReasonServer; got != exp {
+		t.Fatalf(`close reason mismatch: expect %s got %s`, exp, got)
+	}
+
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatalf(`Start returned error: %s`, err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`Start did not return after Shutdown`)
+	}
+
+	if !srv.isClosed() {
+		t.Fatalf(`server is not closed after Shutdown`)
+	}
+}
+
+// Тест на истечение контекста Shutdown: клиент ничего не читает, так что соединение закрывается принудительно
+func Test_TCPServer_Shutdown_2(t *testing.T) {
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	connected := make(chan bool, 1)
+	reasons := make(chan CloseReason, 1)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		_ = syscall.SetsockoptInt(conn.fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, 4096)
+		_, _ = conn.Write(make([]byte, 4*1024*1024))
+		connected <- true
+		return true
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		reasons <- reason
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientConnect was not called`)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf(`Shutdown returned wrong error: %v`, err)
+	}
+
+	select {
+	case reason := <-reasons:
+		if reason != CloseReasonServer {
+			t.Fatalf(`close reason mismatch: expect %s got %s`, CloseReasonServer, reason)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`connection was not closed after Shutdown timeout`)
+	}
+}
+
+// Тест на IdleTimeout: активное соединение живет, молчащее закрывается
+// Тест на закрытие дескрипторов сервера, который так и не был запущен
+func Test_TCPServer_Shutdown_3(t *testing.T) {
+	countFds := func() int {
+		fds, err := ioutil.ReadDir(`/proc/self/fd`)
+		if err != nil {
+			t.Skipf(`Cannot read /proc/self/fd: %s`, err)
+		}
+		return len(fds)
+	}
+
+	before := countFds()
+
+	for i := 0; i < 10; i++ {
+		srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 2})
+		if err != nil {
+			t.Fatalf(`NewServerWithOptions failed: %s`, err)
+		}
+
+		if i%2 == 0 {
+			srv.Close()
+			// Close не ждет горутины воркеров
+			_ = srv.Shutdown(context.Background())
+		} else if err := srv.Shutdown(context.Background()); err != nil {
+			t.Fatalf(`Shutdown failed: %s`, err)
+		}
+	}
+
+	if after := countFds(); after > before {
+		t.Fatalf(`Descriptors leaked: before %d after %d`, before, after)
+	}
+}
+
+func Test_TCPServer_Timeout_1(t *testing.T) {
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1, IdleTimeout: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	reasons := make(chan CloseReason, 2)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		_, _ = conn.Write([]byte(`hello`))
+		return true
+	})
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		conn.RdBuf.Discard(conn.RdBuf.Len())
+		return true
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		reasons <- reason
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+
+	// активность продлевает соединение
+	for i := 0; i < 6; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := client.Write([]byte(`ping`)); err != nil {
+			t.Fatalf(`Could not write to client: %s`, err)
+		}
+	}
+
+	select {
+	case reason := <-reasons:
+		t.Fatalf(`active connection was closed: %s`, reason)
+	default:
+	}
+
+	started := time.Now()
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if readed, err := ioutil.ReadAll(client); err != nil {
+		t.Fatalf(`Could not read from client: %s`, err)
+	} else if string(readed) != `hello` {
+		t.Fatalf(`Unexpected data from server: %q`, readed)
+	}
+
+	if elapsed := time.Since(started); elapsed < 200*time.Millisecond {
+		t.Fatalf(`connection was closed too early: %s`, elapsed)
+	}
+
+	if got, exp := <-reasons, CloseReasonTimeout; got != exp {
+		t.Fatalf(`close reason mismatch: expect %s got %s`, exp, got)
+	}
+}
+
+// Тест на WriteTimeout и переопределение таймаутов для отдельного соединения
+func Test_TCPServer_Timeout_2(t *testing.T) {
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1, ReadTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	reasons := make(chan CloseReason, 1)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		// клиент ничего не шлет, так что без этого соединение закрылось бы по ReadTimeout
+		conn.SetReadTimeout(0)
+		conn.SetWriteTimeout(300 * time.Millisecond)
+
+		_ = syscall.SetsockoptInt(conn.fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, 4096)
+		_, _ = conn.Write(make([]byte, 4*1024*1024))
+		return true
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		reasons <- reason
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+
+	started := time.Now()
+
+	select {
+	case reason := <-reasons:
+		if reason != CloseReasonTimeout {
+			t.Fatalf(`close reason mismatch: expect %s got %s`, CloseReasonTimeout, reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf(`connection was not closed by WriteTimeout`)
+	}
+
+	if elapsed := time.Since(started); elapsed < 250*time.Millisecond {
+		t.Fatalf(`connection was closed too early (ReadTimeout override ignored?): %s`, elapsed)
+	}
+}
+
+// Тест на IdleTimeout для соединения, по которому не было ни одного события
+func Test_TCPServer_Timeout_3(t *testing.T) {
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1, IdleTimeout: 300 * time.Millisecond})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	reasons := make(chan CloseReason, 1)
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		reasons <- reason
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	// ни клиент, ни сервер ничего не отправляют
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+
+	select {
+	case reason := <-reasons:
+		if reason != CloseReasonTimeout {
+			t.Fatalf(`close reason mismatch: expect %s got %s`, CloseReasonTimeout, reason)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf(`silent connection was not closed by IdleTimeout`)
+	}
+}
+
+// Тест на приостановку чтения по ReadHighWater: пока обработчик не вычитывает RdBuf, он не растет выше порога
+func Test_TCPServer_ReadBackpressure_1(t *testing.T) {
+	const (
+		highWater = 64 * 1024
+		readBuf   = 16 * 1024
+		total     = 32 * 1024 * 1024 // заведомо больше буферов сокетов
+	)
+
+	srv, err := NewServerWithOptions(ServerOptions{
+		Host:           `127.0.0.1`,
+		Workers:        1,
+		ReadBufferSize: readBuf,
+		ReadHighWater:  highWater,
+	})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	var (
+		maxRdBuf  int
+		received  int
+		consume   bool
+		conns     = make(chan *TCPConn, 1)
+		completed = make(chan bool, 1)
+	)
+
+	drain := func(conn *TCPConn) {
+		buf := make([]byte, 64*1024)
+		for {
+			n, _ := conn.Read(buf)
+			if n == 0 {
+				break
+			}
+			received += n
+		}
+		if received == total {
+			completed <- true
+		}
+	}
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		if l := conn.RdBuf.Len(); l > maxRdBuf {
+			maxRdBuf = l
+		}
+
+		if consume {
+			drain(conn)
+		} else {
+			select {
+			case conns <- conn:
+			default:
+			}
+		}
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_ = client.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, err := client.Write(make([]byte, total))
+		writeErr <- err
+	}()
+
+	var conn *TCPConn
+	select {
+	case conn = <-conns:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientRead was not called`)
+	}
+
+	time.Sleep(200 * time.Millisecond) // клиент упирается в TCP окно
+
+	select {
+	case err := <-writeErr:
+		t.Fatalf(`client write was not blocked by backpressure: %v`, err)
+	default:
+	}
+
+	result := make(chan int, 1)
+	conn.worker.postFunc(func() {
+		result <- maxRdBuf
+		consume = true
+		drain(conn) // снимает приостановку чтения
+	})
+
+	if got := <-result; got > highWater+readBuf {
+		t.Fatalf(`RdBuf grew above high water: %d`, got)
+	}
+
+	select {
+	case <-completed:
+	case <-time.After(3 * time.Second):
+		t.Fatalf(`not all data was received after resume`)
+	}
+
+	if err := <-writeErr; err != nil {
+		t.Fatalf(`client write failed: %s`, err)
+	}
+}
+
+// Тест на PauseRead/ResumeRead
+func Test_TCPServer_ReadBackpressure_2(t *testing.T) {
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	conns := make(chan *TCPConn, 1)
+	reads := make(chan string, 1)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		conn.PauseRead()
+		conns <- conn
+		return true
+	})
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		buf := make([]byte, conn.RdBuf.Len())
+		n, _ := conn.Read(buf)
+		reads <- string(buf[:n])
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+
+	conn := <-conns
+
+	if _, err := client.Write([]byte(`hello`)); err != nil {
+		t.Fatalf(`Could not write to client: %s`, err)
+	}
+
+	select {
+	case data := <-reads:
+		t.Fatalf(`data was read while paused: %q`, data)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	conn.worker.postFunc(conn.ResumeRead)
+
+	select {
+	case data := <-reads:
+		if data != `hello` {
+			t.Fatalf(`unexpected data after resume: %q`, data)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`data was not read after ResumeRead`)
+	}
+}
+
+func Test_TCPServer_WriteBufferLimit_1(t *testing.T) {
+	const (
+		limit    = 256 * 1024
+		lowWater = 64 * 1024
+		chunk    = 32 * 1024
+		total    = 16 * 1024 * 1024 // заведомо больше буферов сокетов
+	)
+
+	srv, err := NewServerWithOptions(ServerOptions{
+		Host:             `127.0.0.1`,
+		Workers:          1,
+		WriteBufferLimit: limit,
+		WriteLowWater:    lowWater,
+	})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	type stats struct {
+		maxWrBuf, rejected, lowCalls int
+		err                          error
+	}
+
+	var (
+		sent     int
+		st       stats
+		payload  = make([]byte, chunk)
+		finished = make(chan stats, 1)
+	)
+
+	fill := func(conn *TCPConn) bool {
+		for sent < total {
+			if _, err := conn.Write(payload); err == ErrBufferFull {
+				st.rejected++
+				return true
+			} else if err != nil {
+				st.err = err
+				finished <- st
+				return false
+			}
+
+			sent += chunk
+			if l := conn.WrBuf.Len(); l > st.maxWrBuf {
+				st.maxWrBuf = l
+			}
+		}
+
+		finished <- st
+		return true
+	}
+
+	srv.OnClientConnect(fill)
+	srv.OnClientWriteLowWater(func(conn *TCPConn) bool {
+		st.lowCalls++
+		return fill(conn)
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+
+	time.Sleep(200 * time.Millisecond) // сервер упирается в TCP окно и ограничение WrBuf
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := io.CopyN(ioutil.Discard, client, total); err != nil {
+		t.Fatalf(`Could not read from server: %s (%d bytes)`, err, n)
+	}
+
+	var res stats
+	select {
+	case res = <-finished:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`server did not finish writing`)
+	}
+
+	if res.err != nil {
+		t.Fatalf(`Write failed: %s`, res.err)
+	} else if res.maxWrBuf > limit {
+		t.Fatalf(`WrBuf exceeded the limit: %d > %d`, res.maxWrBuf, limit)
+	} else if res.rejected == 0 {
+		t.Fatalf(`Write was never rejected with ErrBufferFull`)
+	} else if res.lowCalls != res.rejected {
+		t.Fatalf(`OnClientWriteLowWater calls mismatch: %d calls for %d rejects`, res.lowCalls, res.rejected)
+	}
+}
+
+// Тест на уведомление, когда после отказа Write следующая запись целиком уходит в сокет
+func Test_TCPServer_WriteBufferLimit_2(t *testing.T) {
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1, WriteBufferLimit: 100, WriteLowWater: 50})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	connected := make(chan *TCPConn, 1)
+	lowWater := make(chan struct{}, 1)
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		connected <- conn
+		return true
+	})
+	srv.OnClientWriteLowWater(func(conn *TCPConn) bool {
+		lowWater <- struct{}{}
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+
+	var conn *TCPConn
+	select {
+	case conn = <-connected:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientConnect was not called`)
+	}
+
+	results := make(chan error, 2)
+	conn.Post(func() {
+		// WrBuf выше порога, как если бы сокет был забит, и Write получает отказ
+		conn.WrBuf.Write(make([]byte, 80))
+		_, err := conn.Write(make([]byte, 50))
+		results <- err
+
+		// WrBuf частично отправлен, а следующая запись уходит в сокет целиком, так что EPOLLOUT уже не будет
+		conn.WrBuf.Read(make([]byte, 80))
+		_, err = conn.Write([]byte(`hello`))
+		results <- err
+	})
+
+	if err := <-results; err != ErrBufferFull {
+		t.Fatalf(`Write over limit returned %v`, err)
+	} else if err := <-results; err != nil {
+		t.Fatalf(`Write failed: %s`, err)
+	}
+
+	select {
+	case <-lowWater:
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientWriteLowWater was not called after rejected Write`)
+	}
+
+	buf := make([]byte, 5)
+	_ = client.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf(`Could not read from server: %s`, err)
+	} else if string(buf) != `hello` {
+		t.Fatalf(`unexpected data: %q`, buf)
+	}
+}
+
+func Test_TCPConn_SetWriteBufferLimit(t *testing.T) {
+	var conn TCPConn
+
+	conn.SetWriteBufferLimit(100, -1)
+	if (conn.writeLimit != 100) || (conn.writeLowWater != 50) {
+		t.Fatalf(`wrong default low water: %d/%d`, conn.writeLimit, conn.writeLowWater)
+	}
+
+	conn.SetWriteBufferLimit(100, 100)
+	if conn.writeLowWater != 50 {
+		t.Fatalf(`low water must be less than limit: %d`, conn.writeLowWater)
+	}
+
+	conn.WrBuf.Write(make([]byte, 60))
+	if _, err := conn.Write(make([]byte, 50)); err != ErrBufferFull {
+		t.Fatalf(`Write over limit returned %v`, err)
+	} else if conn.WrBuf.Len() != 60 {
+		t.Fatalf(`rejected Write changed WrBuf: %d`, conn.WrBuf.Len())
+	} else if !conn.writeAboveLow {
+		t.Fatalf(`rejected Write must wait for low water`)
+	}
+
+	conn.SetWriteBufferLimit(0, 0)
+	if conn.writeAboveLow {
+		t.Fatalf(`disabled limit must not wait for low water`)
+	}
+}
+
+func Test_TCPServer_ConnContext(t *testing.T) {
+	srv, err := NewServerWithOptions(ServerOptions{Host: `127.0.0.1`, Workers: 1})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	port := getSocketPort(srv.fd)
+	if port == 0 {
+		t.Fatalf(`Cannot determine test socket port`)
+	}
+
+	type session struct {
+		id uint64
+	}
+
+	var (
+		closed  = make(chan *TCPConn, 2)
+		cleared = make(chan bool, 2)
+	)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		conn.Context = &session{id: conn.ID()}
+		return true
+	})
+
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		if sess, ok := conn.Context.(*session); !ok || (sess.id != conn.ID()) {
+			t.Errorf(`wrong Context in OnClientClose: %#v`, conn.Context)
+		}
+		closed <- conn
+
+		// к следующей итерации воркера соединение уже закрыто
+		conn.worker.postFunc(func() {
+			cleared <- conn.Context == nil
+		})
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	var ids []uint64
+	for i := 0; i < 2; i++ {
+		client, err := net.DialTimeout(`tcp`, `127.0.0.1:`+strconv.Itoa(port), 1*time.Second)
+		if err != nil {
+			t.Fatalf(`Could not dial to server: %s`, err)
+		}
+		_ = client.Close()
+
+		select {
+		case conn := <-closed:
+			ids = append(ids, conn.ID())
+		case <-time.After(1 * time.Second):
+			t.Fatalf(`OnClientClose was not called`)
+		}
+
+		select {
+		case ok := <-cleared:
+			if !ok {
+				t.Fatalf(`Context was not cleared after close`)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatalf(`worker did not run posted func`)
+		}
+	}
+
+	if (ids[0] == 0) || (ids[1] <= ids[0]) {
+		t.Fatalf(`connection IDs must grow monotonically: %v`, ids)
+	}
+}
@@ -0,0 +1,546 @@
+package gonetz
+
+import (
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+type (
+	// tcpWorker обслуживает один epoll и все зарегистрированные в нем соединения.
+	// Таблица clients принадлежит горутине воркера, поэтому поиск соединения по fd не требует блокировок.
+	// Другие горутины общаются с воркером только через очереди под mu
+	tcpWorker struct {
+		srv     *TCPServer
+		epoll   *EPoll
+		clients map[int]*TCPConn
+
+		// собственный слушающий сокет воркера в режиме ServerOptions.ReusePort (0 - соединения раздает Start)
+		listenFd      int
+		acceptAddr    sockaddrBuf
+		acceptPaused  bool      // в очереди ядра могли остаться соединения (см. TCPServer.acceptNext)
+		acceptRetryAt time.Time // когда повторить прием (нулевое - при любом пробуждении)
+
+		mu       sync.Mutex
+		incoming []*TCPConn // новые соединения, еще не попавшие в clients
+		tasks    []*TCPConn // соединения, которым из других горутин запрошено закрытие
+		funcs    []func()   // функции, которые нужно выполнить в горутине воркера (см. postFunc)
+		stopped  bool       // горутина воркера завершилась, новые соединения не принимаются
+
+		draining bool // идет Shutdown: соединения закрываются после отправки WrBuf
+
+		now    time.Time // время последнего пробуждения
+		timers timerWheel
+	}
+)
+
+func (w *tcpWorker) init(srv *TCPServer, epoll *EPoll) {
+	w.srv = srv
+	w.epoll = epoll
+	w.clients = make(map[int]*TCPConn)
+	w.timers.init(timerWheelTick, timerWheelSlots)
+}
+
+// register передает соединение воркеру и добавляет его в epoll.
+// Возвращает false, если воркер уже остановлен: тогда соединение нужно закрыть самостоятельно.
+// Может вызываться из любой горутины, conn.worker уже должен указывать на w
+func (w *tcpWorker) register(conn *TCPConn) bool {
+	// обработчик подключения мог что-то записать в WrBuf, так что маску событий беру из соединения
+	events := conn.wantedEvents()
+	conn.events = events
+
+	// соединение попадает в очередь до добавления в epoll, т.к. воркер может сразу же получить по нему событие.
+	// После этого соединение принадлежит воркеру и его поля здесь уже не трогаю
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return false
+	}
+	w.incoming = append(w.incoming, conn)
+	w.mu.Unlock()
+
+	if err := w.epoll.addClient(conn.fd, events, !conn.unix); err != nil {
+		conn.requestClose(closeModeAbort, CloseReasonError)
+		w.post(conn)
+		return true
+	}
+
+	// по соединению может не быть ни одного события (клиент молчит), а забрать его из incoming и запустить
+	// таймауты воркер должен в любом случае
+	_ = w.epoll.Wakeup()
+
+	return true
+}
+
+// post просит воркер проверить запрос на закрытие соединения и будит его.
+// Может вызываться из любой горутины
+func (w *tcpWorker) post(conn *TCPConn) {
+	if w == nil {
+		// соединение не привязано к воркеру
+		return
+	}
+
+	w.mu.Lock()
+	if !w.stopped {
+		w.tasks = append(w.tasks, conn)
+	}
+	w.mu.Unlock()
+
+	_ = w.epoll.Wakeup()
+}
+
+// postFunc выполняет fn в горутине воркера. Если воркер уже остановлен, fn выполняется сразу в текущей горутине.
+// Может вызываться из любой горутины
+func (w *tcpWorker) postFunc(fn func()) {
+	w.mu.Lock()
+	stopped := w.stopped
+	if !stopped {
+		w.funcs = append(w.funcs, fn)
+	}
+	w.mu.Unlock()
+
+	if stopped {
+		fn()
+		return
+	}
+
+	_ = w.epoll.Wakeup()
+}
+
+// isStopped сообщает, что горутина воркера завершается или уже завершилась.
+// Может вызываться из любой горутины
+func (w *tcpWorker) isStopped() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stopped
+}
+
+// processQueues забирает новые соединения и запросы из других горутин
+func (w *tcpWorker) processQueues() {
+	w.mu.Lock()
+	incoming, tasks, funcs := w.incoming, w.tasks, w.funcs
+	w.incoming, w.tasks, w.funcs = nil, nil, nil
+	w.mu.Unlock()
+
+	for _, conn := range incoming {
+		w.clients[conn.fd] = conn
+
+		if conn.dial == nil { // у исходящих соединений таймауты начинают действовать после connect
+			conn.lastRead, conn.lastWrite = w.now, w.now
+			w.updateTimer(conn)
+		}
+	}
+
+	for _, conn := range incoming {
+		w.closeIfRequested(conn)
+	}
+
+	for _, conn := range tasks {
+		if w.clients[conn.fd] == conn { // соединение еще не закрыто
+			w.closeIfRequested(conn)
+		}
+	}
+
+	for _, fn := range funcs {
+		fn()
+	}
+}
+
+func (srv *TCPServer) startWorkerLoop(w *tcpWorker) error {
+	var (
+		readBuf = make([]byte, srv.readBufferSize())
+
+		// соединения, у которых в сокете могли остаться непрочитанные данные
+		pending, nextPending []*TCPConn
+	)
+
+	for {
+		if srv.isClosed() || (srv.isShuttingDown() && w.drain()) {
+			w.stop()
+			return nil
+		}
+
+		timeout := w.epoll.WaitTimeout
+		if len(pending) > 0 {
+			// edge-triggered epoll не сообщит повторно о недочитанных данных, так что не жду
+			timeout = 0
+		} else if t, ok := w.timers.nextTimeout(time.Now()); ok && ((timeout < 0) || (t < timeout)) {
+			timeout = t
+		}
+		if w.acceptPaused && !w.acceptRetryAt.IsZero() {
+			timeout = retryTimeout(timeout, w.acceptRetryAt, time.Now())
+		}
+
+		nEvents, errno := w.epoll.WaitFor(timeout)
+		w.now = time.Now()
+		if errno != 0 {
+			if errno == syscall.EINTR {
+				runtime.Gosched()
+				continue
+			}
+			return errno
+		}
+
+		w.processQueues()
+		w.timers.advance(w.now, w.expireTimer)
+
+		if w.acceptPaused && (w.listenFd != 0) && !w.now.Before(w.acceptRetryAt) {
+			w.acceptAll()
+		}
+
+		if (nEvents == 0) && (len(pending) == 0) {
+			// пробуждение через EPoll.Wakeup, по таймеру (или истек WaitTimeout)
+			continue
+		}
+
+		for ev := 0; ev < nEvents; ev++ {
+			clientFd := int(w.epoll.events[ev].Fd)
+			eventsMask := w.epoll.events[ev].Events
+
+			if (clientFd == w.listenFd) && (w.listenFd != 0) {
+				w.acceptAll()
+				continue
+			}
+
+			conn, ok := w.clients[clientFd]
+			if !ok {
+				continue
+			}
+
+			if (conn.dial != nil) && !w.finishDial(conn, eventsMask) {
+				continue
+			}
+
+			if (eventsMask & syscall.EPOLLIN) != 0 {
+				if !conn.readPending && w.readClient(conn, readBuf) {
+					conn.readPending = true
+					nextPending = append(nextPending, conn)
+				}
+			} else if (eventsMask & (syscall.EPOLLERR | syscall.EPOLLHUP)) != 0 {
+				w.closeClient(conn, CloseReasonError)
+				continue
+			}
+
+			if (eventsMask & syscall.EPOLLOUT) != 0 {
+				// можно дописывать то, что не получилось отправить сразу
+				if w.clients[clientFd] == conn {
+					w.flushClient(conn)
+				}
+			}
+		}
+
+		for _, conn := range pending {
+			conn.readPending = false
+			if w.clients[conn.fd] != conn {
+				// соединение уже закрыто
+				continue
+			} else if w.readClient(conn, readBuf) {
+				conn.readPending = true
+				nextPending = append(nextPending, conn)
+			}
+		}
+
+		pending, nextPending = nextPending, pending[:0]
+	}
+}
+
+// acceptAll принимает все ожидающие соединения на собственном слушающем сокете воркера
+func (w *tcpWorker) acceptAll() {
+	w.acceptPaused, w.acceptRetryAt = false, time.Time{}
+
+	for {
+		clientFd, retry, errno := w.srv.acceptNext(w.listenFd, &w.acceptAddr)
+		if errno == syscall.EINTR || errno == syscall.ECONNABORTED {
+			continue
+		} else if errno != 0 {
+			// EAGAIN - обработаны все новые коннекты (или прием приостановлен)
+			// ToDo: log
+			if (errno == syscall.EAGAIN) && (retry != 0) {
+				w.acceptPaused = true
+				if retry > 0 {
+					w.acceptRetryAt = w.now.Add(retry)
+				}
+			}
+			return
+		}
+
+		w.srv.acceptConn(clientFd, w, &w.acceptAddr)
+	}
+}
+
+// closeListener закрывает собственный слушающий сокет воркера
+func (w *tcpWorker) closeListener() {
+	w.mu.Lock()
+	listenFd := w.listenFd
+	w.listenFd = 0
+	w.mu.Unlock()
+
+	if listenFd == 0 {
+		return
+	}
+
+	_ = w.epoll.DeleteFd(listenFd)
+	_, _, _ = syscall.Syscall(syscall.SYS_CLOSE, uintptr(listenFd), 0, 0)
+}
+
+// drain переводит все соединения воркера в режим закрытия после отправки WrBuf.
+// Возвращает true, когда соединений больше не осталось
+func (w *tcpWorker) drain() bool {
+	if !w.draining {
+		w.draining = true
+		w.closeListener()
+	}
+
+	w.processQueues()
+
+	for _, conn := range w.clients {
+		conn.requestClose(closeModeFlush, CloseReasonServer) // ранее запрошенное закрытие не перетирается
+		w.closeIfRequested(conn)
+	}
+
+	return len(w.clients) == 0
+}
+
+// stop закрывает слушающий сокет, все соединения и epoll воркера.
+// После этого новые соединения закрываются сразу в register
+func (w *tcpWorker) stop() {
+	w.closeListener()
+
+	w.mu.Lock()
+	w.stopped = true
+	w.mu.Unlock()
+
+	w.closeAll(CloseReasonServer)
+	_ = w.epoll.Close()
+}
+
+// readClient вычитывает данные из сокета до EAGAIN, но не более maxReadsPerEvent раз за вызов.
+// Возвращает true, если бюджет исчерпан, а в сокете еще могут оставаться данные
+func (w *tcpWorker) readClient(conn *TCPConn, readBuf []byte) (more bool) {
+	var (
+		readBufPtr = uintptr(unsafe.Pointer(&readBuf[0]))
+		readBufLen = uintptr(len(readBuf))
+
+		readed, closed bool
+		reason         CloseReason
+	)
+
+	if !conn.readAllowed() {
+		// чтение приостановлено, а о новых данных сообщит EPOLLIN после его возобновления
+		return false
+	}
+
+	more = true
+	for reads := 0; reads < maxReadsPerEvent; reads++ {
+		r1, _, errno := syscall.Syscall(syscall.SYS_READ, uintptr(conn.fd), readBufPtr, readBufLen)
+		nbytes := int(r1)
+
+		if errno == syscall.EINTR {
+			continue
+		} else if errno == syscall.EAGAIN {
+			// обработаны все новые данные
+			more = false
+			break
+		} else if errno != 0 {
+			// syscall.EBADF, syscall.ECONNRESET, ...
+			closed, reason = true, closeReasonByErrno(errno)
+			break
+		} else if nbytes == 0 {
+			// соединение закрылось
+			closed, reason = true, CloseReasonEOF
+			break
+		}
+
+		conn.lastRead = w.now
+
+		if mode, _ := conn.closeRequest(); mode != closeModeNone {
+			// соединение ждет закрытия и новые данные уже не нужны
+		} else if conn.tls == nil {
+			_, _ = conn.RdBuf.Write(readBuf[:nbytes])
+			readed = true
+		} else if plain, err := conn.tls.input(readBuf[:nbytes], readBuf); err != nil {
+			readed = readed || plain
+			closed, reason = true, tlsCloseReason(err)
+			break
+		} else if plain {
+			readed = true
+		}
+
+		if conn.readBufFull() {
+			// дальше решит обработчик: если он не вычитает RdBuf, то чтение будет приостановлено,
+			// а иначе соединение дочитается в следующей итерации (more == true)
+			break
+		}
+		// короткое чтение не означает, что сокет вычитан: вместе с данными мог прийти FIN,
+		// о котором edge-triggered epoll отдельно уже не сообщит, так что читаю до EAGAIN
+	}
+
+	if readed && conn.proxyPending {
+		readed = w.readProxyHeader(conn)
+	}
+
+	if readed && !w.srv.readEvent(conn) {
+		conn.CloseAfterFlush()
+	}
+	conn.updateReadThrottle()
+
+	if closed && (reason == CloseReasonEOF) {
+		w.eofClient(conn)
+		return false
+	} else if closed {
+		w.closeClient(conn, reason)
+		return false
+	} else if w.closeIfRequested(conn) {
+		return false
+	}
+
+	return more
+}
+
+// eofClient обрабатывает FIN от клиента. Клиент мог закрыть только свою сторону соединения и ждать ответа,
+// так что WrBuf в любом случае досылается, а оставить соединение открытым для записи может OnClientEOF
+func (w *tcpWorker) eofClient(conn *TCPConn) {
+	if mode, _ := conn.closeRequest(); (mode != closeModeNone) || conn.preConnect {
+		// обработчики о соединении еще не знают или оно уже закрывается
+		conn.requestClose(closeModeFlush, CloseReasonEOF)
+	} else {
+		conn.readEOF = true
+		conn.updateEventsIfRegistered()
+
+		if !w.srv.eofEvent(conn) {
+			conn.requestClose(closeModeFlush, CloseReasonEOF)
+		}
+	}
+
+	w.closeIfRequested(conn)
+}
+
+func (w *tcpWorker) flushClient(conn *TCPConn) {
+	if conn.WrBuf.Len() == 0 {
+		return
+	}
+
+	if err := conn.flush(); err != nil {
+		w.closeClient(conn, closeReasonByErrno(err))
+		return
+	}
+
+	w.notifyWriteLowWater(conn)
+
+	if mode, _ := conn.closeRequest(); (conn.WrBuf.Len() == 0) && (mode == closeModeNone) {
+		if !w.srv.writeEvent(conn) {
+			conn.CloseAfterFlush()
+		}
+		conn.updateReadThrottle()
+	}
+
+	w.closeIfRequested(conn)
+}
+
+// notifyWriteLowWater вызывает OnClientWriteLowWater, если WrBuf после превышения порога опустился до writeLowWater
+func (w *tcpWorker) notifyWriteLowWater(conn *TCPConn) {
+	if mode, _ := conn.closeRequest(); (mode == closeModeNone) && conn.writeAboveLow && (conn.WrBuf.Len() <= conn.writeLowWater) {
+		conn.writeAboveLow = false
+		if !w.srv.writeLowWaterEvent(conn) {
+			conn.CloseAfterFlush()
+		}
+	}
+}
+
+// connectConn передает обработчикам соединение, OnClientConnect которого был отложен до получения заголовка
+// PROXY protocol: вызывает OnClientConnect или начинает TLS handshake.
+// Возвращает true, если в RdBuf есть данные для OnClientRead
+func (w *tcpWorker) connectConn(conn *TCPConn) bool {
+	if config := w.srv.options.TLSConfig; config != nil {
+		conn.setupTLS(config, w.srv.tlsHandshakeTimeout(), w.now)
+		w.updateTimer(conn)
+		// данные после заголовка - это уже начало handshake
+		conn.tls.in = make([]byte, conn.RdBuf.Len())
+		_, _ = conn.RdBuf.Read(conn.tls.in)
+		w.beginTLS(conn)
+		return false
+	}
+
+	conn.preConnect = false
+	if !w.srv.cnEvent(conn) {
+		conn.CloseAfterFlush()
+	}
+
+	mode, _ := conn.closeRequest()
+	return (mode == closeModeNone) && (conn.RdBuf.Len() > 0)
+}
+
+// updateTimer планирует проверку таймаутов соединения, если она нужна раньше уже запланированной
+func (w *tcpWorker) updateTimer(conn *TCPConn) {
+	at := conn.deadline()
+	if at.IsZero() || (conn.dial != nil) {
+		return
+	} else if !conn.timerAt.IsZero() && !conn.timerAt.After(at) {
+		// уже запланированная проверка наступит раньше, а там соединение будет перепланировано
+		return
+	}
+
+	conn.timerGen++
+	conn.timerAt = at
+	w.timers.add(conn, at, w.now)
+}
+
+// expireTimer проверяет таймауты соединения, для которого сработал таймер
+func (w *tcpWorker) expireTimer(conn *TCPConn) {
+	if w.clients[conn.fd] != conn {
+		// соединение уже закрыто
+		return
+	}
+
+	conn.timerAt = time.Time{}
+
+	if at := conn.deadline(); at.IsZero() {
+	} else if !at.After(w.now) {
+		w.closeClient(conn, CloseReasonTimeout)
+	} else {
+		w.updateTimer(conn)
+	}
+}
+
+// closeIfRequested закрывает соединение, если это было запрошено (TCPConn.Close, TCPConn.CloseAfterFlush
+// или false из ConnEvent). Возвращает true, если соединение было закрыто
+func (w *tcpWorker) closeIfRequested(conn *TCPConn) bool {
+	mode, reason := conn.closeRequest()
+
+	switch mode {
+	case closeModeAbort:
+		_ = syscall.SetsockoptLinger(conn.fd, syscall.SOL_SOCKET, syscall.SO_LINGER, &syscall.Linger{Onoff: 1})
+	case closeModeFlush:
+		if conn.tls != nil {
+			conn.tls.closeNotify()
+		}
+		if conn.WrBuf.Len() > 0 {
+			// закрою после отправки всего WrBuf по EPOLLOUT
+			return false
+		}
+	default:
+		return false
+	}
+
+	w.closeClient(conn, reason)
+	return true
+}
+
+// closeClient удаляет соединение из воркера и закрывает его
+func (w *tcpWorker) closeClient(conn *TCPConn, reason CloseReason) {
+	delete(w.clients, conn.fd)
+	_ = w.epoll.DeleteFd(conn.fd)
+
+	w.srv.closeConn(conn, reason)
+}
+
+// closeAll закрывает все соединения воркера
+func (w *tcpWorker) closeAll(reason CloseReason) {
+	w.processQueues()
+
+	for _, conn := range w.clients {
+		w.closeClient(conn, reason)
+	}
+}
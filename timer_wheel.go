@@ -0,0 +1,92 @@
+package gonetz
+
+import (
+	"time"
+)
+
+const (
+	// timerWheelTick - точность таймаутов соединений
+	timerWheelTick = 100 * time.Millisecond
+	// timerWheelSlots - размер колеса. Более далекие сроки перепланируются при очередном обороте
+	timerWheelSlots = 512
+)
+
+type (
+	// timerWheel - хешированное колесо таймеров воркера. Используется только из горутины воркера.
+	// На каждое соединение в колесе лежит не более одной актуальной записи: при продлении срока запись
+	// не переносится, а при срабатывании соединение само планируется заново (см. tcpWorker.expireTimer).
+	// Устаревшие записи отсеиваются по TCPConn.timerGen
+	timerWheel struct {
+		tick  time.Duration
+		slots [][]timerEntry
+		pos   int       // текущий слот
+		base  time.Time // начало текущего слота
+		count int       // всего записей в колесе, включая устаревшие
+	}
+
+	timerEntry struct {
+		conn *TCPConn
+		gen  uint32
+	}
+)
+
+func (wheel *timerWheel) init(tick time.Duration, slots int) {
+	wheel.tick = tick
+	wheel.slots = make([][]timerEntry, slots)
+}
+
+// add планирует срабатывание для conn не раньше at
+func (wheel *timerWheel) add(conn *TCPConn, at, now time.Time) {
+	if wheel.count == 0 {
+		// колесо стояло, так что его начало давно устарело
+		wheel.base = now
+	}
+
+	offset := int(at.Sub(wheel.base) / wheel.tick)
+	if offset < 0 {
+		offset = 0
+	} else if offset >= len(wheel.slots) {
+		offset = len(wheel.slots) - 1
+	}
+
+	idx := (wheel.pos + offset) % len(wheel.slots)
+	wheel.slots[idx] = append(wheel.slots[idx], timerEntry{conn: conn, gen: conn.timerGen})
+	wheel.count++
+}
+
+// advance прокручивает колесо до now и вызывает fn для всех актуальных записей из пройденных слотов
+func (wheel *timerWheel) advance(now time.Time, fn func(conn *TCPConn)) {
+	if wheel.count == 0 {
+		return
+	}
+
+	for (wheel.count > 0) && !now.Before(wheel.base.Add(wheel.tick)) {
+		slot := wheel.slots[wheel.pos]
+		wheel.slots[wheel.pos] = nil
+
+		// сдвигаю колесо до вызова fn, т.к. fn может планировать новые срабатывания
+		wheel.pos = (wheel.pos + 1) % len(wheel.slots)
+		wheel.base = wheel.base.Add(wheel.tick)
+		wheel.count -= len(slot)
+
+		for _, entry := range slot {
+			if entry.gen == entry.conn.timerGen {
+				fn(entry.conn)
+			}
+		}
+	}
+}
+
+// nextTimeout возвращает время до конца текущего слота. ok == false, если колесо пустое
+func (wheel *timerWheel) nextTimeout(now time.Time) (timeout Millisecond, ok bool) {
+	if wheel.count == 0 {
+		return 0, false
+	}
+
+	d := wheel.base.Add(wheel.tick).Sub(now)
+	if d <= 0 {
+		return 0, true
+	}
+
+	return Millisecond((d + time.Millisecond - 1) / time.Millisecond), true
+}
@@ -0,0 +1,86 @@
+package gonetz
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_timerWheel(t *testing.T) {
+	var (
+		wheel timerWheel
+		now   = time.Now()
+		fired []*TCPConn
+	)
+
+	wheel.init(10*time.Millisecond, 8)
+
+	collect := func(conn *TCPConn) {
+		fired = append(fired, conn)
+	}
+
+	if _, ok := wheel.nextTimeout(now); ok {
+		t.Fatalf(`nextTimeout for empty wheel returned ok`)
+	}
+
+	var (
+		soon  = &TCPConn{}
+		later = &TCPConn{}
+		far   = &TCPConn{}
+		stale = &TCPConn{}
+	)
+
+	wheel.add(soon, now.Add(5*time.Millisecond), now)
+	wheel.add(later, now.Add(25*time.Millisecond), now)
+	wheel.add(far, now.Add(time.Second), now) // дальше, чем все колесо
+	wheel.add(stale, now.Add(5*time.Millisecond), now)
+	stale.timerGen++ // запись устарела
+
+	if got, exp := wheel.count, 4; got != exp {
+		t.Fatalf(`count mismatch: expect %d got %d`, exp, got)
+	}
+
+	if timeout, ok := wheel.nextTimeout(now); !ok || (timeout != 10) {
+		t.Fatalf(`nextTimeout mismatch: %d %v`, timeout, ok)
+	}
+
+	wheel.advance(now.Add(5*time.Millisecond), collect)
+	if len(fired) != 0 {
+		t.Fatalf(`timers fired before the end of slot`)
+	}
+
+	wheel.advance(now.Add(10*time.Millisecond), collect)
+	if (len(fired) != 1) || (fired[0] != soon) {
+		t.Fatalf(`wrong timers fired at the end of first slot: %v`, fired)
+	}
+
+	fired = fired[:0]
+	wheel.advance(now.Add(30*time.Millisecond), collect)
+	if (len(fired) != 1) || (fired[0] != later) {
+		t.Fatalf(`wrong timers fired at the end of third slot: %v`, fired)
+	}
+
+	// далекий срок срабатывает на последнем слоте колеса, а дальше соединение перепланируется само
+	fired = fired[:0]
+	wheel.advance(now.Add(80*time.Millisecond), collect)
+	if (len(fired) != 1) || (fired[0] != far) {
+		t.Fatalf(`far timer was not fired after full turn: %v`, fired)
+	}
+
+	if got, exp := wheel.count, 0; got != exp {
+		t.Fatalf(`count after all timers mismatch: expect %d got %d`, exp, got)
+	}
+
+	// после простоя колесо начинает отсчет заново
+	now = now.Add(time.Hour)
+	wheel.add(soon, now.Add(15*time.Millisecond), now)
+
+	fired = fired[:0]
+	wheel.advance(now.Add(10*time.Millisecond), collect)
+	if len(fired) != 0 {
+		t.Fatalf(`timer fired too early after idle wheel`)
+	}
+	wheel.advance(now.Add(20*time.Millisecond), collect)
+	if (len(fired) != 1) || (fired[0] != soon) {
+		t.Fatalf(`timer was not fired after idle wheel: %v`, fired)
+	}
+}
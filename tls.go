@@ -0,0 +1,364 @@
+package gonetz
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// tlsScratchSize - размер временного буфера для расшифровки данных, пришедших вместе с handshake
+	tlsScratchSize = 16 * 1024
+)
+
+type (
+	// tlsLayer - TLS поверх TCPConn (см. ServerOptions.TLSConfig).
+	// Для crypto/tls он выглядит как net.Conn: Read отдает зашифрованные данные, прочитанные воркером из сокета,
+	// а Write дописывает записи TLS в WrBuf.
+	// crypto/tls не умеет неблокирующий handshake (ошибку Read из handshake tls.Conn запоминает навсегда),
+	// поэтому handshake выполняется в отдельной горутине, которая ждет данных от воркера в Read. Количество таких
+	// горутин ограничено ServerOptions.TLSMaxHandshakes. После handshake tls.Conn используется только из горутины
+	// воркера: расшифровка выполняется при чтении из сокета (readClient), а шифрование - в TCPConn.Write
+	tlsLayer struct {
+		conn *tls.Conn
+		tc   *TCPConn
+
+		// меняются только в горутине воркера
+		established   bool      // handshake завершен успешно и OnClientConnect уже вызван
+		closeNotified bool      // close_notify уже отправлен
+		deadline      time.Time // срок завершения handshake (zero - без ограничения), см. ServerOptions.TLSHandshakeTimeout
+
+		mu          sync.Mutex
+		cond        sync.Cond
+		in          []byte // прочитанные из сокета и еще не разобранные tls.Conn данные
+		handshaking bool
+		closed      bool // соединение закрыто, Read handshake больше не дождется данных
+	}
+
+	// tlsLimiter ограничивает количество одновременных TLS handshake (см. ServerOptions.TLSMaxHandshakes)
+	tlsLimiter struct {
+		mu      sync.Mutex
+		max     int // <= 0 - без ограничения
+		active  int
+		waiting []*TCPConn // соединения, ждущие места под handshake
+	}
+
+	// tlsWouldBlock возвращается Read, когда прочитанные из сокета данные закончились.
+	// crypto/tls не запоминает временные ошибки, так что после новых данных из сокета чтение можно продолжить
+	tlsWouldBlock struct{}
+)
+
+var (
+	errTLSWouldBlock net.Error = tlsWouldBlock{}
+
+	// errTLSClosed возвращается Write, когда соединение уже закрыто
+	errTLSClosed = fmt.Errorf(`tls: use of closed connection`)
+)
+
+func (tlsWouldBlock) Error() string   { return `tls: no buffered input` }
+func (tlsWouldBlock) Timeout() bool   { return true }
+func (tlsWouldBlock) Temporary() bool { return true }
+
+func newTLSLayer(tc *TCPConn, config *tls.Config) *tlsLayer {
+	l := &tlsLayer{tc: tc, handshaking: true}
+	l.cond.L = &l.mu
+	l.conn = tls.Server(l, config)
+	return l
+}
+
+// TLSState возвращает параметры TLS соединения (версия, шифр, SNI, ALPN, сертификаты клиента)
+// или nil, если соединение без TLS
+func (conn *TCPConn) TLSState() *tls.ConnectionState {
+	if (conn.tls == nil) || !conn.tls.established {
+		return nil
+	}
+
+	state := conn.tls.conn.ConnectionState()
+	return &state
+}
+
+// setupTLS подготавливает TLS только что принятого соединения. Handshake начнется после startTLS
+// и должен завершиться за timeout от now (timeout < 0 - без ограничения)
+func (conn *TCPConn) setupTLS(config *tls.Config, timeout time.Duration, now time.Time) {
+	// адрес нужен до handshake (tls.ClientHelloInfo.Conn), а LocalAddr из горутины handshake вызывать нельзя
+	conn.LocalAddr()
+	conn.tls = newTLSLayer(conn, config)
+	if timeout > 0 {
+		conn.tls.deadline = now.Add(timeout)
+	}
+}
+
+// beginTLS запускает handshake соединения, уже переданного воркеру, или ставит его в очередь,
+// если занято ServerOptions.TLSMaxHandshakes мест. Вызывается из горутины воркера
+func (w *tcpWorker) beginTLS(conn *TCPConn) {
+	if conn.tls.isClosed() || w.isStopped() {
+		return
+	} else if !w.srv.tlsHandshakes.acquire(conn) {
+		// пока handshake не начался, данные клиента ждут в буфере ядра
+		conn.readPaused = true
+		conn.updateEventsIfRegistered()
+		return
+	}
+
+	w.runTLS(conn)
+}
+
+// runTLS запускает handshake соединения, которому уже досталось место в tlsLimiter.
+// Если соединение успело закрыться, то место передается следующему. Вызывается из горутины воркера
+func (w *tcpWorker) runTLS(conn *TCPConn) {
+	if conn.tls.isClosed() || w.isStopped() {
+		w.srv.tlsHandshakes.release()
+		return
+	}
+
+	conn.readPaused = false
+	conn.updateEventsIfRegistered()
+	conn.startTLS()
+}
+
+// startTLS запускает горутину handshake.
+// OnClientConnect будет вызван воркером после успешного handshake (см. tlsHandshakeDone)
+func (conn *TCPConn) startTLS() {
+	go func() {
+		err := conn.tls.conn.Handshake()
+		conn.worker.srv.tlsHandshakes.release()
+		conn.Post(func() {
+			conn.worker.tlsHandshakeDone(conn, err)
+		})
+	}()
+}
+
+// tlsHandshakeDone завершает handshake в горутине воркера
+func (w *tcpWorker) tlsHandshakeDone(conn *TCPConn, err error) {
+	if conn.tls.isClosed() || w.isStopped() {
+		// соединение закрылось во время handshake (таймаут, остановка сервера).
+		// У остановленного воркера Post выполняется вне его горутины, а соединение закроет closeAll
+		return
+	}
+
+	if err != nil {
+		// alert о неудачном handshake уже в WrBuf
+		conn.requestClose(closeModeFlush, CloseReasonError)
+		w.closeIfRequested(conn)
+		return
+	} else if mode, _ := conn.closeRequest(); mode != closeModeNone {
+		// например, Shutdown во время handshake: обработчики о соединении так и не узнают
+		w.closeIfRequested(conn)
+		return
+	}
+
+	l := conn.tls
+	l.mu.Lock()
+	l.handshaking = false
+	l.mu.Unlock()
+	l.established = true
+	conn.preConnect = false
+
+	if !w.srv.cnEvent(conn) {
+		conn.CloseAfterFlush()
+	}
+
+	// клиент мог отправить данные сразу после своего Finished
+	if mode, _ := conn.closeRequest(); mode == closeModeNone {
+		plain, err := l.decrypt(make([]byte, tlsScratchSize))
+		if err != nil {
+			w.closeClient(conn, tlsCloseReason(err))
+			return
+		} else if plain && !w.srv.readEvent(conn) {
+			conn.CloseAfterFlush()
+		}
+		conn.updateReadThrottle()
+	}
+
+	w.closeIfRequested(conn)
+}
+
+// acquire занимает место под handshake conn. Если мест нет, то conn ставится в очередь и возвращается false:
+// handshake начнется через runTLS, когда место освободится
+func (l *tlsLimiter) acquire(conn *TCPConn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if (l.max > 0) && (l.active >= l.max) {
+		l.waiting = append(l.waiting, conn)
+		return false
+	}
+
+	l.active++
+	return true
+}
+
+// release освобождает место завершившегося handshake или передает его первому еще не закрытому
+// соединению из очереди. Может вызываться из любой горутины
+func (l *tlsLimiter) release() {
+	l.mu.Lock()
+	for len(l.waiting) > 0 {
+		conn := l.waiting[0]
+		l.waiting[0] = nil
+		l.waiting = l.waiting[1:]
+
+		if !conn.tls.isClosed() {
+			l.mu.Unlock()
+			conn.Post(func() {
+				conn.worker.runTLS(conn)
+			})
+			return
+		}
+	}
+	l.active--
+	l.mu.Unlock()
+}
+
+// input передает прочитанные из сокета данные raw в TLS и расшифровывает все, что возможно, в RdBuf.
+// buf - временный буфер для расшифровки (может быть тем же буфером, что и raw).
+// plain сообщает о появлении новых данных в RdBuf, а err (io.EOF для close_notify) - о необходимости закрыть соединение
+func (l *tlsLayer) input(raw, buf []byte) (plain bool, err error) {
+	l.mu.Lock()
+	l.in = append(l.in, raw...)
+	handshaking := l.handshaking
+	if handshaking {
+		l.cond.Signal()
+	}
+	l.mu.Unlock()
+
+	if handshaking {
+		// данные заберет горутина handshake
+		return false, nil
+	}
+	return l.decrypt(buf)
+}
+
+// decrypt расшифровывает в RdBuf все полные записи TLS из l.in
+func (l *tlsLayer) decrypt(buf []byte) (plain bool, err error) {
+	for {
+		n, err := l.conn.Read(buf)
+		if n > 0 {
+			_, _ = l.tc.RdBuf.Write(buf[:n])
+			plain = true
+		}
+
+		if err == errTLSWouldBlock {
+			return plain, nil
+		} else if err != nil {
+			return plain, err
+		}
+	}
+}
+
+// write шифрует b в WrBuf
+func (l *tlsLayer) write(b []byte) (n int, err error) {
+	if !l.established {
+		return 0, ErrTLSHandshake
+	}
+	return l.conn.Write(b)
+}
+
+// closeNotify отправляет close_notify перед закрытием соединения после отправки WrBuf
+func (l *tlsLayer) closeNotify() {
+	if l.established && !l.closeNotified {
+		l.closeNotified = true
+		_ = l.conn.CloseWrite()
+	}
+}
+
+// close будит ждущую данных горутину handshake. Вызывается при закрытии соединения
+func (l *tlsLayer) close() {
+	l.mu.Lock()
+	l.closed = true
+	l.in = nil
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+func (l *tlsLayer) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// Read реализует net.Conn для tls.Conn.
+// Во время handshake ждет данных от воркера, а после него возвращает errTLSWouldBlock, если данных нет
+func (l *tlsLayer) Read(b []byte) (n int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for (len(l.in) == 0) && l.handshaking && !l.closed {
+		l.cond.Wait()
+	}
+
+	if len(l.in) == 0 {
+		if l.closed {
+			return 0, io.EOF
+		}
+		return 0, errTLSWouldBlock
+	}
+
+	n = copy(b, l.in)
+	l.in = l.in[:copy(l.in, l.in[n:])]
+	return n, nil
+}
+
+// Write реализует net.Conn для tls.Conn.
+// Записи handshake передаются в горутину воркера, а после handshake tls.Conn пишет уже из нее
+func (l *tlsLayer) Write(b []byte) (n int, err error) {
+	l.mu.Lock()
+	handshaking, closed := l.handshaking, l.closed
+	l.mu.Unlock()
+
+	if closed {
+		return 0, errTLSClosed
+	} else if !handshaking {
+		return l.tc.writeRaw(b)
+	}
+
+	data := append([]byte(nil), b...)
+	l.tc.Post(func() {
+		if !l.isClosed() && !l.tc.worker.isStopped() {
+			_, _ = l.tc.writeRaw(data)
+		}
+	})
+	return len(b), nil
+}
+
+// Close реализует net.Conn для tls.Conn. Соединение закрывает воркер, так что здесь ничего не делается
+func (l *tlsLayer) Close() error {
+	return nil
+}
+
+// LocalAddr реализует net.Conn для tls.Conn (доступен в tls.ClientHelloInfo.Conn)
+func (l *tlsLayer) LocalAddr() net.Addr {
+	// заполняется в acceptConn до начала handshake
+	return l.tc.localAddr
+}
+
+// RemoteAddr реализует net.Conn для tls.Conn
+func (l *tlsLayer) RemoteAddr() net.Addr {
+	return l.tc.remoteAddr
+}
+
+// SetDeadline реализует net.Conn для tls.Conn. Таймауты обеспечивает воркер (см. TCPConn.SetIdleTimeout)
+func (l *tlsLayer) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline реализует net.Conn для tls.Conn
+func (l *tlsLayer) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline реализует net.Conn для tls.Conn
+func (l *tlsLayer) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// tlsCloseReason возвращает причину закрытия соединения по ошибке расшифровки
+func tlsCloseReason(err error) CloseReason {
+	if err == io.EOF {
+		// close_notify от клиента
+		return CloseReasonEOF
+	}
+	return CloseReasonError
+}
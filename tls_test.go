@@ -0,0 +1,326 @@
+package gonetz
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCertificate создает самоподписанный сертификат для name
+func testCertificate(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf(`GenerateKey failed: %s`, err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf(`CreateCertificate failed: %s`, err)
+	}
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	if cert.Leaf, err = x509.ParseCertificate(der); err != nil {
+		t.Fatalf(`ParseCertificate failed: %s`, err)
+	}
+	return cert
+}
+
+func testRootCAs(certs ...tls.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert.Leaf)
+	}
+	return pool
+}
+
+func Test_TCPServer_TLS_Echo(t *testing.T) {
+	cert := testCertificate(t, `echo.test`)
+	srv, addr := newTestServer(t, ServerOptions{TLSConfig: &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{`h2`, `echo`},
+	}})
+
+	states := make(chan *tls.ConnectionState, 1)
+	closed := make(chan CloseReason, 1)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		states <- conn.TLSState()
+		return true
+	})
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		data := make([]byte, conn.RdBuf.Len())
+		conn.Read(data)
+
+		if _, err := conn.Write(data); err != nil {
+			t.Errorf(`Write failed: %s`, err)
+		}
+		// после bye закрываю соединение сам, клиент должен получить close_notify
+		return !bytes.HasSuffix(data, []byte(`bye`))
+	})
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		closed <- reason
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := tls.Dial(`tcp`, addr, &tls.Config{
+		RootCAs:    testRootCAs(cert),
+		ServerName: `echo.test`,
+		NextProtos: []string{`echo`},
+	})
+	if err != nil {
+		t.Fatalf(`tls.Dial failed: %s`, err)
+	}
+	defer client.Close()
+
+	if proto := client.ConnectionState().NegotiatedProtocol; proto != `echo` {
+		t.Fatalf(`wrong client ALPN protocol: %q`, proto)
+	}
+
+	select {
+	case state := <-states:
+		if state == nil {
+			t.Fatalf(`TLSState in OnClientConnect is nil`)
+		} else if state.NegotiatedProtocol != `echo` {
+			t.Fatalf(`wrong server ALPN protocol: %q`, state.NegotiatedProtocol)
+		} else if state.ServerName != `echo.test` {
+			t.Fatalf(`wrong server SNI: %q`, state.ServerName)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf(`OnClientConnect was not called`)
+	}
+
+	// данных больше, чем влезает в одну запись TLS и в буфер чтения воркера
+	payload := bytes.Repeat([]byte(`0123456789abcdef`), 64*1024)
+	go func() {
+		_, _ = client.Write(payload)
+	}()
+
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	echo := make([]byte, len(payload))
+	if _, err := io.ReadFull(client, echo); err != nil {
+		t.Fatalf(`Read echo failed: %s`, err)
+	} else if !bytes.Equal(echo, payload) {
+		t.Fatalf(`Echo mismatch`)
+	}
+
+	if _, err := client.Write([]byte(`bye`)); err != nil {
+		t.Fatalf(`Write bye failed: %s`, err)
+	} else if rest, err := ioutil.ReadAll(client); err != nil {
+		// io.EOF (close_notify от сервера) ReadAll не считает ошибкой
+		t.Fatalf(`Read after bye failed: %s`, err)
+	} else if string(rest) != `bye` {
+		t.Fatalf(`wrong answer for bye: %q`, rest)
+	}
+
+	select {
+	case reason := <-closed:
+		if reason != CloseReasonHandler {
+			t.Fatalf(`wrong close reason: %s`, reason)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf(`OnClientClose was not called`)
+	}
+}
+
+func Test_TCPServer_TLS_SNI(t *testing.T) {
+	certs := map[string]tls.Certificate{
+		`a.test`: testCertificate(t, `a.test`),
+		`b.test`: testCertificate(t, `b.test`),
+	}
+
+	srv, addr := newTestServer(t, ServerOptions{TLSConfig: &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.Conn.LocalAddr() == nil {
+				t.Errorf(`LocalAddr is not available in GetCertificate`)
+			}
+			cert := certs[hello.ServerName]
+			return &cert, nil
+		},
+	}})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	for _, name := range []string{`a.test`, `b.test`} {
+		client, err := tls.Dial(`tcp`, addr, &tls.Config{
+			RootCAs:    testRootCAs(certs[`a.test`], certs[`b.test`]),
+			ServerName: name,
+		})
+		if err != nil {
+			t.Fatalf(`tls.Dial to %s failed: %s`, name, err)
+		}
+
+		peer := client.ConnectionState().PeerCertificates[0]
+		client.Close()
+
+		if peer.Subject.CommonName != name {
+			t.Fatalf(`wrong certificate for %s: %s`, name, peer.Subject.CommonName)
+		}
+	}
+}
+
+func Test_TCPServer_TLS_HandshakeFail(t *testing.T) {
+	cert := testCertificate(t, `fail.test`)
+	srv, addr := newTestServer(t, ServerOptions{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}})
+
+	events := make(chan string, 2)
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		events <- `connect`
+		return true
+	})
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		events <- `close`
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	// клиент без TLS
+	client, err := net.Dial(`tcp`, addr)
+	if err != nil {
+		t.Fatalf(`Dial failed: %s`, err)
+	}
+	defer client.Close()
+
+	if _, err := client.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+		t.Fatalf(`Write failed: %s`, err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(client); err != nil {
+		t.Fatalf(`Server did not close connection: %s`, err)
+	}
+
+	select {
+	case event := <-events:
+		t.Fatalf(`unexpected %s event for failed handshake`, event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Тест на закрытие соединения, не завершившего handshake за TLSHandshakeTimeout
+func Test_TCPServer_TLS_HandshakeTimeout(t *testing.T) {
+	cert := testCertificate(t, `timeout.test`)
+	srv, addr := newTestServer(t, ServerOptions{
+		TLSConfig:           &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSHandshakeTimeout: 200 * time.Millisecond,
+	})
+
+	events := make(chan string, 2)
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		events <- `connect`
+		return true
+	})
+	srv.OnClientClose(func(conn *TCPConn, reason CloseReason) {
+		events <- `close`
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	// клиент подключается и молчит, IdleTimeout и ReadTimeout не заданы
+	client, err := net.Dial(`tcp`, addr)
+	if err != nil {
+		t.Fatalf(`Dial failed: %s`, err)
+	}
+	defer client.Close()
+
+	started := time.Now()
+	client.SetReadDeadline(started.Add(2 * time.Second))
+	if _, err := ioutil.ReadAll(client); err != nil {
+		t.Fatalf(`Server did not close connection: %s`, err)
+	} else if elapsed := time.Since(started); elapsed < 150*time.Millisecond {
+		t.Fatalf(`connection was closed too early: %s`, elapsed)
+	}
+
+	select {
+	case event := <-events:
+		t.Fatalf(`unexpected %s event for timed out handshake`, event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Тест на TLSMaxHandshakes: пока единственное место занято молчащим клиентом, handshake следующего не начинается
+func Test_TCPServer_TLS_MaxHandshakes(t *testing.T) {
+	cert := testCertificate(t, `max.test`)
+	srv, addr := newTestServer(t, ServerOptions{
+		Workers:          2,
+		TLSConfig:        &tls.Config{Certificates: []tls.Certificate{cert}},
+		TLSMaxHandshakes: 1,
+	})
+
+	connected := make(chan bool, 1)
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		connected <- true
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	silent, err := net.Dial(`tcp`, addr)
+	if err != nil {
+		t.Fatalf(`Dial failed: %s`, err)
+	}
+	defer silent.Close()
+	time.Sleep(50 * time.Millisecond) // молчащий клиент должен занять место первым
+
+	clients := make(chan *tls.Conn, 1)
+	go func() {
+		dialer := &net.Dialer{Timeout: 2 * time.Second}
+		client, err := tls.DialWithDialer(dialer, `tcp`, addr, &tls.Config{
+			RootCAs:    testRootCAs(cert),
+			ServerName: `max.test`,
+		})
+		if err != nil {
+			t.Errorf(`tls.Dial failed: %s`, err)
+		}
+		clients <- client
+	}()
+	defer func() {
+		// клиент закрывается только в конце теста, т.к. сервер завершает handshake после него
+		if client := <-clients; client != nil {
+			_ = client.Close()
+		}
+	}()
+
+	select {
+	case <-connected:
+		t.Fatalf(`handshake was started over TLSMaxHandshakes`)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// место освобождается закрытием молчащего клиента
+	_ = silent.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(2 * time.Second):
+		t.Fatalf(`waiting handshake was not started after close`)
+	}
+}
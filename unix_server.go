@@ -0,0 +1,102 @@
+package gonetz
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var (
+	// ErrUnixPathInUse возвращается, если по пути unix сокета уже что-то есть и это не брошенный сокет
+	ErrUnixPathInUse = fmt.Errorf(`unix socket path is in use`)
+)
+
+// NewUnixServer создает новый сервер на unix сокете с настройками по умолчанию.
+// path - путь к файлу сокета, либо имя в abstract namespace с префиксом @
+func NewUnixServer(path string) (srv *TCPServer, err error) {
+	return NewServerWithOptions(ServerOptions{Network: `unix`, Host: path})
+}
+
+// PeerCred возвращает pid/uid/gid процесса на другой стороне unix сокета (SO_PEERCRED).
+// Для TCP соединений возвращает nil
+func (conn *TCPConn) PeerCred() *syscall.Ucred {
+	return conn.peerCred
+}
+
+func (srv *TCPServer) newListenerUnix(path string) (err error) {
+	if (path == ``) || (path == `@`) {
+		return ErrWrongHost
+	}
+
+	abstract := path[0] == '@'
+
+	if !abstract {
+		if err = removeStaleUnixSocket(path); err != nil {
+			return err
+		}
+	}
+
+	if err = srv.listen(syscall.AF_UNIX, &syscall.SockaddrUnix{Name: path}); err != nil {
+		return err
+	}
+
+	if abstract {
+		return nil
+	}
+
+	srv.unixPath = path
+
+	return nil
+}
+
+// setupUnixSocketMode выставляет права файлу unix сокета (ServerOptions.UnixSocketMode).
+// Вызывается между bind и listen, чтобы никто не успел подключиться, пока у файла права по umask
+func (srv *TCPServer) setupUnixSocketMode(addr syscall.Sockaddr) error {
+	unixAddr, ok := addr.(*syscall.SockaddrUnix)
+	if !ok || (srv.options.UnixSocketMode == 0) || (unixAddr.Name[0] == '@') {
+		return nil
+	}
+
+	if err := os.Chmod(unixAddr.Name, srv.options.UnixSocketMode); err != nil {
+		// файл создан только что нашим bind
+		_ = os.Remove(unixAddr.Name)
+		return err
+	}
+	return nil
+}
+
+// removeStaleUnixSocket удаляет файл unix сокета, оставшийся от не завершившегося корректно процесса.
+// Файл, не являющийся сокетом, и сокет, на котором кто-то слушает, не трогаются
+func removeStaleUnixSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if (fi.Mode() & os.ModeSocket) == 0 {
+		return ErrUnixPathInUse
+	}
+
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	err = syscall.Connect(fd, &syscall.SockaddrUnix{Name: path})
+	_ = syscall.Close(fd)
+
+	if err == nil {
+		return ErrUnixPathInUse
+	} else if err != syscall.ECONNREFUSED {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func (srv *TCPServer) setupUnixConn(conn *TCPConn) {
+	conn.unix = true
+
+	if cred, err := syscall.GetsockoptUcred(conn.fd, syscall.SOL_SOCKET, syscall.SO_PEERCRED); err == nil {
+		conn.peerCred = cred
+	}
+}
@@ -0,0 +1,160 @@
+package gonetz
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_UnixServer_newListenerUnix(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `gonetz`)
+	if err != nil {
+		t.Fatalf(`TempDir failed: %s`, err)
+	}
+	defer os.RemoveAll(dir)
+
+	var srv TCPServer
+
+	if err := srv.newListenerUnix(``); err != ErrWrongHost {
+		t.Fatalf(`newListenerUnix for empty path returned wrong error: %v`, err)
+	}
+
+	// обычный файл трогать нельзя
+	regular := filepath.Join(dir, `regular`)
+	if err := ioutil.WriteFile(regular, []byte(`data`), 0600); err != nil {
+		t.Fatalf(`WriteFile failed: %s`, err)
+	}
+	if err := srv.newListenerUnix(regular); err != ErrUnixPathInUse {
+		t.Fatalf(`newListenerUnix over regular file returned wrong error: %v`, err)
+	}
+
+	// брошенный сокет удаляется
+	stale := filepath.Join(dir, `stale.sock`)
+	if ln, err := net.Listen(`unix`, stale); err != nil {
+		t.Fatalf(`net.Listen failed: %s`, err)
+	} else {
+		ln.(*net.UnixListener).SetUnlinkOnClose(false)
+		_ = ln.Close()
+	}
+	if err := srv.newListenerUnix(stale); err != nil {
+		t.Fatalf(`newListenerUnix over stale socket failed: %s`, err)
+	}
+
+	// занятый сокет не удаляется
+	var srv2 TCPServer
+	if err := srv2.newListenerUnix(stale); err != ErrUnixPathInUse {
+		t.Fatalf(`newListenerUnix over active socket returned wrong error: %v`, err)
+	}
+
+	srv.closeListener()
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf(`unix socket file was not removed by closeListener: %v`, err)
+	}
+}
+
+func Test_UnixServer_NewServerWithOptions(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `gonetz`)
+	if err != nil {
+		t.Fatalf(`TempDir failed: %s`, err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, `srv.sock`)
+
+	srv, err := NewServerWithOptions(ServerOptions{Network: `unix`, Host: path, UnixSocketMode: 0600, Workers: 1})
+	if err != nil {
+		t.Fatalf(`NewServerWithOptions failed: %s`, err)
+	}
+
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatalf(`Stat failed: %s`, err)
+	} else if got, exp := fi.Mode().Perm(), os.FileMode(0600); got != exp {
+		t.Fatalf(`Wrong unix socket permissions. Expect %s got %s`, exp, got)
+	}
+
+	srv.Close()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf(`unix socket file was not removed by Close: %v`, err)
+	}
+
+	if _, err := NewServerWithOptions(ServerOptions{Network: `udp`}); err != ErrWrongNetwork {
+		t.Fatalf(`NewServerWithOptions with wrong network returned wrong error: %v`, err)
+	}
+}
+
+func testUnixServerEcho(t *testing.T, path string) {
+	srv, err := NewUnixServer(path)
+	if err != nil {
+		t.Fatalf(`NewUnixServer failed: %s`, err)
+	}
+
+	creds := make(chan *syscall.Ucred, 1)
+
+	srv.OnClientConnect(func(conn *TCPConn) bool {
+		creds <- conn.PeerCred()
+		return true
+	})
+
+	srv.OnClientRead(func(conn *TCPConn) bool {
+		buf := make([]byte, conn.RdBuf.Len())
+		n, _ := conn.Read(buf)
+		_, _ = conn.Write(buf[:n])
+		return true
+	})
+
+	stop := startTestServer(t, srv)
+	defer stop()
+
+	client, err := net.DialTimeout(`unix`, path, 1*time.Second)
+	if err != nil {
+		t.Fatalf(`Could not dial to server: %s`, err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(1 * time.Second))
+
+	select {
+	case cred := <-creds:
+		if cred == nil {
+			t.Fatalf(`PeerCred is nil for unix connection`)
+		} else if got, exp := int(cred.Pid), os.Getpid(); got != exp {
+			t.Fatalf(`Wrong peer pid. Expect %d got %d`, exp, got)
+		} else if got, exp := int(cred.Uid), os.Getuid(); got != exp {
+			t.Fatalf(`Wrong peer uid. Expect %d got %d`, exp, got)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf(`OnClientConnect was not called`)
+	}
+
+	req := []byte(`ping`)
+	resp := make([]byte, len(req))
+	if _, err := client.Write(req); err != nil {
+		t.Fatalf(`Could not write: %s`, err)
+	} else if _, err := io.ReadFull(client, resp); err != nil {
+		t.Fatalf(`Could not read: %s`, err)
+	} else if !bytes.Equal(req, resp) {
+		t.Fatalf(`Response differs from request`)
+	}
+}
+
+func Test_UnixServer_Start_1(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `gonetz`)
+	if err != nil {
+		t.Fatalf(`TempDir failed: %s`, err)
+	}
+	defer os.RemoveAll(dir)
+
+	testUnixServerEcho(t, filepath.Join(dir, `srv.sock`))
+}
+
+// Тест на abstract namespace
+func Test_UnixServer_Start_2(t *testing.T) {
+	testUnixServerEcho(t, `@gonetz-test-`+strconv.Itoa(os.Getpid()))
+}